@@ -0,0 +1,333 @@
+// Copyright (c) 2016, RetailNext, Inc.
+// This material contains trade secrets and confidential information of
+// RetailNext, Inc.  Any use, reproduction, disclosure or dissemination
+// is strictly prohibited without the explicit written permission
+// of RetailNext, Inc.
+// All rights reserved.
+
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	sessionCookie     = "trekchat_session"
+	sessionTTL        = 7 * 24 * time.Hour
+	minPasswordLength = 8
+	hashIterations    = 100000
+	hashLength        = 32
+)
+
+var errBadCredentials = errors.New("invalid name or password")
+
+type account struct {
+	Name    string      `json:"name"`
+	Salt    []byte      `json:"salt"`
+	Hash    []byte      `json:"hash"`
+	Created time.Time   `json:"created"`
+	Stats   clientStats `json:"stats"`
+}
+
+// userStore holds registered accounts, persisted as a JSON file when path
+// is set.
+type userStore struct {
+	sync.Mutex
+	path     string
+	accounts map[string]*account
+}
+
+func openUserStore(path string) (*userStore, error) {
+	u := &userStore{
+		path:     path,
+		accounts: make(map[string]*account),
+	}
+	if path == "" {
+		return u, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return u, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var accounts []*account
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %s", path, err)
+	}
+	for _, a := range accounts {
+		u.accounts[a.Name] = a
+	}
+	return u, nil
+}
+
+func hashPassword(password string, salt []byte) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, password, salt, hashIterations, hashLength)
+}
+
+func (u *userStore) register(name, password string) error {
+	if err := validateName(name); err != nil {
+		return err
+	}
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	hash, err := hashPassword(password, salt)
+	if err != nil {
+		return err
+	}
+
+	u.Lock()
+	defer u.Unlock()
+
+	if u.accounts[name] != nil {
+		return fmt.Errorf("name %s is already registered", name)
+	}
+	u.accounts[name] = &account{
+		Name:    name,
+		Salt:    salt,
+		Hash:    hash,
+		Created: time.Now().UTC(),
+	}
+	return u.save()
+}
+
+func (u *userStore) authenticate(name, password string) error {
+	u.Lock()
+	a := u.accounts[name]
+	u.Unlock()
+	if a == nil {
+		return errBadCredentials
+	}
+
+	hash, err := hashPassword(password, a.Salt)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(hash, a.Hash) != 1 {
+		return errBadCredentials
+	}
+	return nil
+}
+
+func (u *userStore) exists(name string) bool {
+	u.Lock()
+	defer u.Unlock()
+	return u.accounts[name] != nil
+}
+
+func (u *userStore) stats(name string) (clientStats, bool) {
+	u.Lock()
+	defer u.Unlock()
+	a := u.accounts[name]
+	if a == nil {
+		return clientStats{}, false
+	}
+	return a.Stats, true
+}
+
+func (u *userStore) saveStats(name string, stats clientStats) error {
+	u.Lock()
+	defer u.Unlock()
+	a := u.accounts[name]
+	if a == nil {
+		return fmt.Errorf("no such account %s", name)
+	}
+	a.Stats = stats
+	return u.save()
+}
+
+// save writes all accounts to disk. The caller must hold the lock.
+func (u *userStore) save() error {
+	if u.path == "" {
+		return nil
+	}
+
+	accounts := make([]*account, 0, len(u.accounts))
+	for _, a := range u.accounts {
+		accounts = append(accounts, a)
+	}
+	data, err := json.MarshalIndent(accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := u.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, u.path)
+}
+
+type session struct {
+	name    string
+	expires time.Time
+}
+
+// sessionStore maps login tokens to account names.
+type sessionStore struct {
+	sync.Mutex
+	sessions map[string]session
+}
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{sessions: make(map[string]session)}
+}
+
+func (ss *sessionStore) create(name string) (string, time.Time, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", time.Time{}, err
+	}
+	token := hex.EncodeToString(buf)
+	expires := time.Now().Add(sessionTTL)
+
+	ss.Lock()
+	ss.sessions[token] = session{name: name, expires: expires}
+	ss.Unlock()
+	return token, expires, nil
+}
+
+func (ss *sessionStore) lookup(token string) (string, bool) {
+	ss.Lock()
+	defer ss.Unlock()
+	sess, ok := ss.sessions[token]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(sess.expires) {
+		delete(ss.sessions, token)
+		return "", false
+	}
+	return sess.name, true
+}
+
+func (ss *sessionStore) revoke(token string) {
+	ss.Lock()
+	delete(ss.sessions, token)
+	ss.Unlock()
+}
+
+// requestToken returns the session token from the request's cookie or its
+// token query parameter.
+func requestToken(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+func (s *server) startSession(w http.ResponseWriter, name string) {
+	token, expires, err := s.sessions.create(name)
+	if err != nil {
+		log.Printf("error creating session: %s", err)
+		http.Error(w, "error creating session", http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"name":  name,
+		"token": token,
+	})
+}
+
+func (s *server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name, password := r.FormValue("name"), r.FormValue("password")
+	if s.nameTaken(name) || s.bans.lookup(name, "") != nil {
+		http.Error(w, "name "+name+" is in use", http.StatusConflict)
+		return
+	}
+	if err := s.users.register(name, password); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Registered account %s", name)
+	s.startSession(w, name)
+}
+
+func (s *server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.FormValue("name")
+	if err := s.users.authenticate(name, r.FormValue("password")); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	s.startSession(w, name)
+}
+
+func (s *server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if token := requestToken(r); token != "" {
+		s.sessions.revoke(token)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   sessionCookie,
+		Path:   "/",
+		MaxAge: -1,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// saveAccountStats copies name's in-memory stats into its account.
+func (s *server) saveAccountStats(name string) {
+	s.RLock()
+	stats := s.clientStats[name]
+	var snapshot clientStats
+	if stats != nil {
+		snapshot = *stats
+	}
+	s.RUnlock()
+
+	if stats == nil {
+		return
+	}
+	if err := s.users.saveStats(name, snapshot); err != nil {
+		log.Printf("Failed saving stats for %s: %s", name, err)
+	}
+}
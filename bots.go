@@ -8,75 +8,349 @@
 package main
 
 import (
+	"fmt"
+	"log"
 	"math/rand"
+	"strings"
 	"time"
 )
 
 type Bot interface {
 	Client
-	Run()
+	// Run drives the bot until stop is closed.
+	Run(stop <-chan struct{})
 }
 
+// botConfig describes a bot to register at startup.
+type botConfig struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+	Room string `json:"room"`
+
+	// Lines are said in turn, one every MinDelay to MaxDelay. The delays
+	// default to the server's bot_min_delay and bot_max_delay.
+	Lines    []string `json:"lines,omitempty"`
+	MinDelay duration `json:"min_delay,omitzero"`
+	MaxDelay duration `json:"max_delay,omitzero"`
+
+	// Triggers are answered whenever a message contains their keyword.
+	Triggers []botTrigger `json:"triggers,omitempty"`
+
+	// MentionReplies are used in turn to answer messages that mention
+	// the bot. Bots without any fall back to their Lines.
+	MentionReplies []string `json:"mention_replies,omitempty"`
+}
+
+type botTrigger struct {
+	Keyword string `json:"keyword"`
+	// Reply may refer to the sender of the triggering message as {sender}.
+	Reply string `json:"reply"`
+}
+
+// botKinds builds a bot of each kind that can be named in the config.
+var botKinds = map[string]func(*server, botConfig) (Bot, error){
+	"scripted": newBot,
+	"reactive": newBot,
+	"romulan": func(s *server, cfg botConfig) (Bot, error) {
+		return romulan{s, cfg.Name}, nil
+	},
+}
+
+func (cfg botConfig) validate() error {
+	if err := validateName(cfg.Name); err != nil {
+		return err
+	}
+	if botKinds[cfg.Kind] == nil {
+		return fmt.Errorf("bot %s has unknown kind %q", cfg.Name, cfg.Kind)
+	}
+	if !roomNamePattern.MatchString(cfg.Room) {
+		return fmt.Errorf("bot %s has invalid room %q", cfg.Name, cfg.Room)
+	}
+	if cfg.Kind == "scripted" && len(cfg.Lines) == 0 {
+		return fmt.Errorf("scripted bot %s has no lines", cfg.Name)
+	}
+	if cfg.Kind == "reactive" && len(cfg.Triggers) == 0 && len(cfg.MentionReplies) == 0 {
+		return fmt.Errorf("reactive bot %s has no triggers or mention replies", cfg.Name)
+	}
+	if cfg.MinDelay.Duration > cfg.MaxDelay.Duration {
+		return fmt.Errorf("bot %s min_delay is longer than max_delay", cfg.Name)
+	}
+	return nil
+}
+
+// botRooms assigns each crew bot to the room it hangs out in.
+var botRooms = map[string]string{
+	"picard":  "bridge",
+	"riker":   "bridge",
+	"worf":    "bridge",
+	"data":    "bridge",
+	"troi":    "bridge",
+	"laforge": "engineering",
+	"barclay": "engineering",
+	"obrien":  "engineering",
+	"wesley":  "engineering",
+	"crusher": "sickbay",
+	"q":       "ten-forward",
+	"borg":    "ten-forward",
+}
+
+// defaultBots is the crew, each saying their own lines in their own room,
+// plus the ship's computer and a romulan.
+func defaultBots(names []string) []botConfig {
+	var bots []botConfig
+	for _, name := range names {
+		room := botRooms[name]
+		if room == "" {
+			room = defaultRoom
+		}
+		bots = append(bots, botConfig{
+			Name:  name,
+			Kind:  "scripted",
+			Room:  room,
+			Lines: enhancements[name],
+		})
+	}
+
+	bots = append(bots, botConfig{
+		Name: "computer",
+		Kind: "reactive",
+		Room: defaultRoom,
+		Triggers: []botTrigger{
+			{Keyword: "tea", Reply: "Tea. Earl Grey. Hot. Now dispensing for {sender}."},
+			{Keyword: "red alert", Reply: "Red alert acknowledged. All hands to battle stations."},
+		},
+		MentionReplies: []string{
+			"Working.",
+			"Unable to comply.",
+			"Please restate the question.",
+		},
+	}, botConfig{
+		Name: "not_romulan",
+		Kind: "romulan",
+		Room: "neutral-zone",
+	})
+	return bots
+}
+
+type botEvent struct {
+	command string
+	args    interface{}
+}
+
+const botInboxSize = 64
+
+// bot says its lines on a schedule and answers private messages, mentions
+// and room messages that contain one of its trigger keywords.
 type bot struct {
-	server       *server
-	name         string
-	enhanceCount int
+	server *server
+	cfg    botConfig
+	inbox  chan botEvent
+
+	nextLine    int
+	nextMention int
+}
+
+func newBot(s *server, cfg botConfig) (Bot, error) {
+	if cfg.MinDelay.Duration == 0 && cfg.MaxDelay.Duration == 0 {
+		cfg.MinDelay, cfg.MaxDelay = s.config.BotMinDelay, s.config.BotMaxDelay
+	}
+	return &bot{
+		server: s,
+		cfg:    cfg,
+		inbox:  make(chan botEvent, botInboxSize),
+	}, nil
 }
 
 func (b *bot) Name() string {
-	return b.name
+	return b.cfg.Name
 }
 
+// SendCommand hands the command to the bot's goroutine, dropping it if the
+// bot has fallen behind.
 func (b *bot) SendCommand(c string, args interface{}) error {
-	return nil
+	select {
+	case b.inbox <- botEvent{c, args}:
+		return nil
+	default:
+		return errQueueFull
+	}
+}
+
+// delay picks a random pause before the bot's next line.
+func (b *bot) delay() time.Duration {
+	min, max := b.cfg.MinDelay.Duration, b.cfg.MaxDelay.Duration
+	return min + time.Duration(rand.Int63n(int64(max-min)+1))
 }
 
-func (b *bot) Run() {
+func (b *bot) Run(stop <-chan struct{}) {
+	var schedule <-chan time.Time
+	if len(b.cfg.Lines) > 0 {
+		schedule = time.After(b.delay())
+	}
+
 	for {
-		time.Sleep(time.Millisecond * (5000 + time.Duration(rand.Intn(30000))))
+		select {
+		case <-schedule:
+			b.say(b.cfg.Lines[b.nextLine%len(b.cfg.Lines)])
+			b.nextLine++
+			schedule = time.After(b.delay())
+		case ev := <-b.inbox:
+			b.handle(ev)
+		case <-stop:
+			return
+		}
+	}
+}
 
-		msg := messageArgs{
-			Sender: b.name,
+func (b *bot) say(text string) {
+	msg := messageArgs{
+		Sender:  b.Name(),
+		Room:    b.cfg.Room,
+		Message: text,
+	}
+	if err := b.send(&msg); err != nil {
+		log.Printf("Bot %s failed to speak: %s", b.Name(), err)
+	}
+}
+
+// send sends msg, running it as a slash command first if it is one, as for
+// any other client.
+func (b *bot) send(msg *messageArgs) error {
+	if strings.HasPrefix(msg.Message, "/") {
+		send, err := b.server.slashCommand(b, msg)
+		if err != nil || !send {
+			return err
 		}
+	}
+	_, err := b.server.sendMessage(b, msg)
+	return err
+}
+
+func (b *bot) handle(ev botEvent) {
+	msg, ok := ev.args.(messageArgs)
+	if !ok || b.server.isBot(msg.Sender) {
+		return
+	}
+
+	var reply string
+	switch ev.command {
+	case "message":
+		if msg.Private {
+			reply = b.mentionReply()
+		} else if !msg.mentions(b.Name()) {
+			reply = b.triggerReply(msg)
+		}
+	case "mention":
+		// Private messages are answered when they arrive.
+		if !msg.Private {
+			reply = b.mentionReply()
+		}
+	}
+	if reply == "" {
+		return
+	}
+
+	out := messageArgs{
+		Sender:  b.Name(),
+		Message: strings.Replace(reply, "{sender}", msg.Sender, -1),
+	}
+	if msg.Private || !b.server.inRoom(b.Name(), msg.Room) {
+		out.Private = true
+		out.Recipient = msg.Sender
+	} else {
+		out.Room = msg.Room
+	}
+	if ev.command == "mention" && !out.Private {
+		// Mentions are only sent once the message is in the history,
+		// so it can be replied to.
+		out.ReplyTo = msg.ID
+	}
+	if err := b.send(&out); err != nil {
+		log.Printf("Bot %s failed to reply to %s: %s", b.Name(), msg.Sender, err)
+	}
+}
 
-		enhanceMessage(b.name, &msg, b.enhanceCount)
-		b.enhanceCount++
+// mentionReply picks the next answer for a message addressed to the bot.
+func (b *bot) mentionReply() string {
+	replies := b.cfg.MentionReplies
+	if len(replies) == 0 {
+		replies = b.cfg.Lines
+	}
+	if len(replies) == 0 {
+		return ""
+	}
+	b.nextMention++
+	return replies[(b.nextMention-1)%len(replies)]
+}
 
-		b.server.sendMessage(b, msg)
+func (b *bot) triggerReply(msg messageArgs) string {
+	text := strings.ToLower(msg.Message)
+	for _, t := range b.cfg.Triggers {
+		if strings.Contains(text, strings.ToLower(t.Keyword)) {
+			return t.Reply
+		}
 	}
+	return ""
 }
 
-func (s *server) initBots() {
-	addBot := func(b Bot) {
+func (s *server) isBot(name string) bool {
+	s.RLock()
+	defer s.RUnlock()
+	_, ok := s.clients[name].(Bot)
+	return ok
+}
+
+func (s *server) initBots() error {
+	addBot := func(b Bot, room string) error {
 		s.clients[b.Name()] = b
 		s.clientStats[b.Name()] = &clientStats{
 			ConnectionCount: 1,
 		}
+		if err := s.joinRoom(b, room); err != nil {
+			return err
+		}
 
-		go b.Run()
+		s.bots.Add(1)
+		go func() {
+			defer s.bots.Done()
+			b.Run(s.stop)
+		}()
+		return nil
 	}
 
-	for _, name := range names {
-		addBot(&bot{s, name, 0})
+	for _, cfg := range s.config.Bots {
+		b, err := botKinds[cfg.Kind](s, cfg)
+		if err != nil {
+			return fmt.Errorf("error creating bot %s: %s", cfg.Name, err)
+		}
+		if err := addBot(b, cfg.Room); err != nil {
+			return fmt.Errorf("error adding bot %s: %s", cfg.Name, err)
+		}
 	}
-
-	addBot(romulan{s})
+	return nil
 }
 
 type romulan struct {
 	server *server
+	name   string
 }
 
 func (r romulan) Name() string {
-	return "not_romulan"
+	return r.name
 }
 
 func (r romulan) SendCommand(c string, args interface{}) error {
 	return nil
 }
 
-func (r romulan) Run() {
+func (r romulan) Run(stop <-chan struct{}) {
 	for i := 0; true; i++ {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
 		if rand.Intn(10000) == 0 {
 			r.server.Lock()
 			time.Sleep(2 * time.Second)
@@ -89,7 +363,7 @@ func (r romulan) Run() {
 			Message:   "death to the federation",
 		}
 
-		if err := r.server.sendMessage(r, msg); err != nil {
+		if _, err := r.server.sendMessage(r, &msg); err != nil {
 			break
 		}
 	}
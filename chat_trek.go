@@ -1,15 +1,22 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"math/rand"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
 	"sort"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -21,38 +28,149 @@ func init() {
 }
 
 func main() {
-	s := &server{
-		clients:     make(map[string]Client),
-		clientStats: make(map[string]*clientStats),
+	flag.Parse()
+
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.apply()
+
+	s := newServer(cfg)
+
+	if cfg.HistoryFile != "" {
+		store, err := openFileStore(cfg.HistoryFile, historyCapacity)
+		if err != nil {
+			log.Fatalf("error opening history file: %s", err)
+		}
+		s.history = store
+	}
+	last := s.history.Recent(1, func(messageArgs) bool { return true })
+	if len(last) > 0 {
+		s.lastMessageID = last[0].ID
+	}
+
+	users, err := openUserStore(cfg.UsersFile)
+	if err != nil {
+		log.Fatalf("error opening users file: %s", err)
+	}
+	s.users = users
+
+	if s.bans, err = openBanList(cfg.BansFile); err != nil {
+		log.Fatalf("error opening bans file: %s", err)
+	}
+	if s.audit, err = openAuditLog(cfg.AuditFile); err != nil {
+		log.Fatalf("error opening audit file: %s", err)
+	}
+
+	if err := s.initBots(); err != nil {
+		log.Fatal(err)
 	}
-	s.initBots()
+
+	go s.watchPresence()
 
 	cannula.HandleFunc("/debug/chat/status", s.debugStatus)
 	cannula.HandleFunc("/debug/chat/user/", s.debugUser)
-	cannula.HandleFunc("/debug/chat/private", s.debugPrivate)
+	cannula.HandleFunc("/debug/chat/events", s.debugEvents)
+	cannula.HandleFunc("/debug/chat/config", s.debugConfig)
+	cannula.HandleFunc("/metrics", s.serveMetrics)
+	cannula.HandleFunc("/debug/chat/moderate/", s.debugModerate)
+	cannula.HandleFunc("/debug/chat/bans", s.debugBans)
+	cannula.HandleFunc("/debug/chat/blacklist/", s.debugBlacklist)
+	cannula.HandleFunc("/debug/chat/audit", s.debugAudit)
 
-	l, err := net.Listen("tcp4", "localhost:8081")
+	l, err := net.Listen("tcp4", cfg.DebugListen)
 	if err != nil {
 		panic(err)
 	}
 	go cannula.Serve(l)
 
 	http.Handle("/connect", http.HandlerFunc(s.handleConnect))
-	http.Handle("/", http.FileServer(http.Dir("static")))
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	http.Handle("/register", http.HandlerFunc(s.handleRegister))
+	http.Handle("/login", http.HandlerFunc(s.handleLogin))
+	http.Handle("/logout", http.HandlerFunc(s.handleLogout))
+	http.Handle("/protocol.json", http.HandlerFunc(serveSchema))
+	http.Handle("/", http.FileServer(http.Dir(cfg.StaticDir)))
+
+	httpServer := &http.Server{Addr: cfg.Listen}
+	go func() {
+		if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	log.Printf("Received %s, shutting down", <-sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout.Duration)
+	defer cancel()
+
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.Printf("error stopping http server: %s", err)
+	}
+	s.shutdown(ctx, "The server is shutting down")
+	l.Close()
+}
+
+// newServer makes a server for cfg that keeps its history, accounts, bans
+// and audit log in memory; main swaps in the files the config names.
+func newServer(cfg *config) *server {
+	return &server{
+		config:      cfg,
+		clients:     make(map[string]Client),
+		resumable:   make(map[string]*connection),
+		clientStats: make(map[string]*clientStats),
+		rooms:       map[string]map[string]Client{defaultRoom: {}},
+		history:     newMemoryStore(historyCapacity),
+		users:       &userStore{accounts: make(map[string]*account)},
+		sessions:    newSessionStore(),
+		limiter:     newRateLimiter(cfg),
+		bans:        &banList{bans: make(map[string]*ban)},
+		audit:       &auditLog{},
+		events:      newEventBus(),
+		clientKeys:  newClientKeys(),
+		stop:        make(chan struct{}),
+	}
 }
 
 type server struct {
 	sync.RWMutex
+	config      *config
 	clients     map[string]Client
 	clientStats map[string]*clientStats
-	privateHook func(Client, messageArgs)
+	rooms       map[string]map[string]Client
+	events      *eventBus
+	clientKeys  *clientKeys
+	history     messageStore
+	users       *userStore
+	sessions    *sessionStore
+	limiter     *rateLimiter
+	bans        *banList
+	audit       *auditLog
+
+	// resumable maps resume tokens to the connections they resume.
+	resumable map[string]*connection
+
+	// lastMessageID is the ID of the most recent message, updated
+	// atomically.
+	lastMessageID int64
+
+	shuttingDown bool
+	stop         chan struct{}
+	bots         sync.WaitGroup
+	conns        sync.WaitGroup
 }
 
 type clientStats struct {
 	BroadcastCount  int64 `json:"broadcast_count"`
 	PrivateCount    int64 `json:"private_count"`
 	ConnectionCount int64 `json:"connection_count"`
+
+	RateLimitedCount     int64     `json:"rate_limited_count"`
+	MuteCount            int64     `json:"mute_count"`
+	FloodDisconnectCount int64     `json:"flood_disconnect_count"`
+	MutedUntil           time.Time `json:"muted_until,omitzero"`
 }
 
 type Client interface {
@@ -60,49 +178,512 @@ type Client interface {
 	Name() string
 }
 
+// webClient is a person using the chat. They may have several connections
+// open at once, one per browser tab or device, and commands sent to them go
+// to each.
 type webClient struct {
 	sync.RWMutex
 	name string
-	conn *websocket.Conn
+	// addr is the address the client first connected from.
+	addr string
+
+	// authenticated is set when name belongs to a registered account.
+	authenticated bool
+	// since is when a guest took its name, which others may have gone by
+	// before. It is zero for registered accounts.
+	since time.Time
+
+	// lastActive is the UnixNano time of the last command read from any of
+	// the client's connections.
+	lastActive int64
+
+	// presence is the state the user picked, and shownIdle whether peers
+	// were last told the user is idle.
+	presence  string
+	shownIdle bool
+	// typing holds when a typing notice was last sent for each room
+	// ("#room") or private recipient ("@name").
+	typing map[string]time.Time
+
+	enhanceCount int
+	// lastSent is the ID of the last message the client sent, which /edit
+	// and /delete act on by default.
+	lastSent int64
+
+	// conns holds the client's connections, mapped to whether they have
+	// been welcomed; only welcomed connections are sent commands.
+	conns map[*connection]bool
+}
+
+// connection is one websocket of a webClient.
+type connection struct {
+	sync.RWMutex
+	// client is only changed, under the lock, by the goroutine reading
+	// commands, which can read it without the lock.
+	client *webClient
+	conn   *websocket.Conn
+	addr   string
+
+	// lastActive is the UnixNano time of the last command read.
+	lastActive int64
+
+	// version is the protocol version the connection speaks and
+	// capabilities the optional features it enabled, both settled by
+	// welcome.
+	version      int
+	capabilities map[string]bool
+	welcomeOnce  sync.Once
+
+	// resumeToken, guarded by the server lock, lets a new connection take
+	// this one's place. detached is set when the connection closes, and
+	// from then on commands sent to it are kept in missed. resumed is set
+	// while it waits to be resumed and closed when it is, after which
+	// commands are forwarded to the connection that took its place;
+	// release is closed instead to stop the wait.
+	resumeToken   string
+	detached      bool
+	missed        [][]byte
+	missedDropped int
+	resumed       chan struct{}
+	release       chan struct{}
+	forward       *connection
+
+	send chan []byte
+	done chan struct{}
+	// stopped is closed once the writer goroutine has put back what it
+	// could not send.
+	stopped   chan struct{}
+	closeOnce sync.Once
+	// closeCode and closeText are set, under the lock, by close.
+	closeCode int
+	closeText string
+}
+
+type overflowPolicy int
+
+const (
+	dropOldest overflowPolicy = iota
+	dropNewest
+	disconnectSlow
+)
+
+var overflowPolicyNames = map[overflowPolicy]string{
+	dropOldest:     "drop-oldest",
+	dropNewest:     "drop-newest",
+	disconnectSlow: "disconnect",
+}
+
+func (p overflowPolicy) String() string {
+	return overflowPolicyNames[p]
+}
+
+func (p *overflowPolicy) Set(name string) error {
+	for policy, n := range overflowPolicyNames {
+		if n == name {
+			*p = policy
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown overflow policy %q", name)
+}
+
+// Connection settings, installed from the config at startup.
+var (
+	outboundQueueSize int
+	outboundOverflow  overflowPolicy
+	writeTimeout      time.Duration
+	pingInterval      time.Duration
+	pongWait          time.Duration
+	idleTimeout       time.Duration
+
+	errClientClosed = errors.New("client closed")
+	errQueueFull    = errors.New("outbound queue full")
+)
+
+func newWebClient(addr string) *webClient {
+	return &webClient{
+		addr:       addr,
+		lastActive: time.Now().UnixNano(),
+		presence:   "online",
+		typing:     make(map[string]time.Time),
+		conns:      make(map[*connection]bool),
+	}
+}
+
+func newConnection(conn *websocket.Conn) *connection {
+	addr, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	c := &connection{
+		conn:       conn,
+		addr:       addr,
+		lastActive: time.Now().UnixNano(),
+		send:       make(chan []byte, outboundQueueSize),
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	go c.writePump()
+	return c
 }
 
 func (c *webClient) Name() string {
+	c.RLock()
+	defer c.RUnlock()
 	return c.name
 }
 
-func (c *webClient) SendCommand(command string, args interface{}) error {
+// setName renames the guest c to a name it has just taken.
+func (c *webClient) setName(name string) {
 	c.Lock()
-	defer c.Unlock()
+	c.name = name
+	c.since = time.Now()
+	c.Unlock()
+}
+
+// SendCommand sends a command to each of c's welcomed connections. It only
+// fails if none of them could be sent it.
+func (c *webClient) SendCommand(command string, args interface{}) error {
+	c.RLock()
+	conns := make([]*connection, 0, len(c.conns))
+	for conn, welcomed := range c.conns {
+		if welcomed {
+			conns = append(conns, conn)
+		}
+	}
+	c.RUnlock()
+
+	err := errClientClosed
+	sent := false
+	for _, conn := range conns {
+		if err = conn.SendCommand(command, args); err == nil {
+			sent = true
+		}
+	}
+	if sent {
+		return nil
+	}
+	return err
+}
+
+// close closes every connection of c.
+func (c *webClient) close(code int, text string) {
+	c.RLock()
+	conns := make([]*connection, 0, len(c.conns))
+	for conn := range c.conns {
+		conns = append(conns, conn)
+	}
+	c.RUnlock()
+
+	for _, conn := range conns {
+		conn.close(code, text)
+	}
+}
+
+// readCommand reads the next command from the websocket, extending the read
+// deadline and recording the activity. A message that is not a command is
+// reported as a *commandError, after which reading can go on.
+func (c *connection) readCommand(command *commandFromClient) error {
+	_, data, err := c.conn.ReadMessage()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UnixNano()
+	atomic.StoreInt64(&c.lastActive, now)
+	atomic.StoreInt64(&c.client.lastActive, now)
+	if err := c.conn.SetReadDeadline(time.Now().Add(pongWait)); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, command); err != nil {
+		return &commandError{Message: "invalid command: " + err.Error()}
+	}
+	return nil
+}
+
+func (c *connection) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActive)))
+}
+
+func (c *connection) Name() string {
+	return c.owner().Name()
+}
+
+func (c *connection) owner() *webClient {
+	c.RLock()
+	defer c.RUnlock()
+	return c.client
+}
+
+// SendCommand queues a command for the writer goroutine without blocking.
+// When the queue is full the configured overflow policy decides what gives.
+func (c *connection) SendCommand(command string, args interface{}) error {
+	args, ok := c.adapt(command, args)
+	if !ok {
+		return nil
+	}
+	err := c.enqueue(command, args)
+	if err != nil {
+		atomic.AddInt64(&metrics.sendFailures, 1)
+	}
+	return err
+}
 
-	err := c.conn.WriteJSON(commandToClient{
+func (c *connection) enqueue(command string, args interface{}) error {
+	msg, err := json.Marshal(commandToClient{
 		Command: command,
 		Args:    args,
 	})
 	if err != nil {
-		log.Printf("Delivery to %s failed: %s", c.name, err)
-		return errors.New("delivery failed")
+		return err
+	}
+	return c.queue(command, msg)
+}
+
+// queue hands an encoded command to the writer goroutine. Once c has
+// closed, the command is kept for a resume instead, or passed on to the
+// connection that resumed c.
+func (c *connection) queue(command string, msg []byte) error {
+	c.Lock()
+	if next := c.forward; next != nil {
+		c.Unlock()
+		return next.queue(command, msg)
+	}
+	if c.detached {
+		c.keep(msg)
+		c.Unlock()
+		return nil
+	}
+	select {
+	case c.send <- msg:
+		c.Unlock()
+		return nil
+	default:
+	}
+
+	switch outboundOverflow {
+	case dropNewest:
+		c.Unlock()
+		log.Printf("Dropping %s command to %s: %s", command, c.Name(), errQueueFull)
+		return errQueueFull
+	case disconnectSlow:
+		c.Unlock()
+		log.Printf("Disconnecting %s: %s", c.Name(), errQueueFull)
+		c.close(websocket.CloseTryAgainLater, "too slow")
+		return errQueueFull
+	}
+
+	// The lock keeps close from slipping in between, so msg is either
+	// queued or kept.
+	defer c.Unlock()
+	for {
+		select {
+		case <-c.send:
+		default:
+		}
+		select {
+		case c.send <- msg:
+			return nil
+		default:
+		}
 	}
-	return nil
 }
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
+// keep adds msg to the commands c missed, dropping the oldest past the size
+// of the outbound queue. The caller must hold c's lock.
+func (c *connection) keep(msg []byte) {
+	if len(c.missed) >= outboundQueueSize {
+		c.missed = c.missed[1:]
+		c.missedDropped++
+	}
+	c.missed = append(c.missed, msg)
 }
 
+// close stops the writer, which flushes what is queued, sends a close frame
+// with code and text and then closes the connection. Commands sent to c
+// afterwards are kept in case it is resumed. Only the first call has any
+// effect.
+func (c *connection) close(code int, text string) {
+	c.closeOnce.Do(func() {
+		c.Lock()
+		c.closeCode = code
+		c.closeText = text
+		c.detached = true
+		c.Unlock()
+		close(c.done)
+	})
+}
+
+func (c *connection) writePump() {
+	ticker := time.NewTicker(pingInterval)
+	var unsent []byte
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+		c.putBack(unsent)
+		close(c.stopped)
+	}()
+
+	for {
+		select {
+		case <-ticker.C:
+			if idleTimeout > 0 && c.idle() > idleTimeout {
+				log.Printf("Disconnecting %s: idle for %s", c.Name(), idleTimeout)
+				c.close(websocket.CloseGoingAway, "idle timeout")
+				continue
+			}
+			err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout))
+			if err != nil {
+				log.Printf("Ping to %s failed: %s", c.Name(), err)
+				c.close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case msg := <-c.send:
+			if err := c.write(msg); err != nil {
+				log.Printf("Delivery to %s failed: %s", c.Name(), err)
+				atomic.AddInt64(&metrics.sendFailures, 1)
+				unsent = msg
+				c.close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case <-c.done:
+			unsent = c.flush()
+			c.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(c.closeCode, c.closeText),
+				time.Now().Add(writeTimeout))
+			return
+		}
+	}
+}
+
+// flush writes whatever is still queued, giving up at the first error and
+// returning the command it could not write.
+func (c *connection) flush() []byte {
+	for {
+		select {
+		case msg := <-c.send:
+			if err := c.write(msg); err != nil {
+				return msg
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// putBack puts unsent and whatever is still queued ahead of the commands
+// kept since c closed, so a resume replays them too. It is called by the
+// writer once c has closed, when nothing more can be queued.
+func (c *connection) putBack(unsent []byte) {
+	var back [][]byte
+	if unsent != nil {
+		back = append(back, unsent)
+	}
+	for len(c.send) > 0 {
+		back = append(back, <-c.send)
+	}
+	c.Lock()
+	c.missed = append(back, c.missed...)
+	c.Unlock()
+}
+
+func (c *connection) write(msg []byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return c.conn.WriteMessage(websocket.TextMessage, msg)
+}
+
+var upgrader websocket.Upgrader
+
 type commandFromClient struct {
 	Command string          `json:"command"`
 	Args    json.RawMessage `json:"args"`
 }
 
 type messageArgs struct {
-	Message   string `json:"message"`
+	Message   string `json:"message" schema:"required"`
 	Private   bool   `json:"private"`
 	Recipient string `json:"recipient"`
+	Room      string `json:"room,omitempty"`
+	// ClientKey is an optional idempotency key chosen by the sender. It is
+	// echoed in the ack but not passed on.
+	ClientKey string `json:"client_key,omitempty"`
+	// ReplyTo is the ID of the message this one answers.
+	ReplyTo int64 `json:"reply_to,omitempty"`
+	// Action marks a message sent with /me.
+	Action bool `json:"action,omitempty"`
 
 	// not populated from client
-	Sender string `json:"sender"`
-	FromMe bool   `json:"from_me"`
+	ID     int64     `json:"id,omitempty" schema:"readonly"`
+	Time   time.Time `json:"time,omitzero" schema:"readonly"`
+	Sender string    `json:"sender" schema:"readonly"`
+	FromMe bool      `json:"from_me" schema:"readonly"`
+
+	// Thread is the ID of the first message of the thread a reply is in,
+	// and Quote an excerpt of the message it answers.
+	Thread int64  `json:"thread,omitempty" schema:"readonly"`
+	Quote  *quote `json:"quote,omitempty" schema:"readonly"`
+
+	// Mentions are the users the message mentions as @name.
+	Mentions []string `json:"mentions,omitempty" schema:"readonly"`
+
+	// Edited is set when the message was last edited or deleted, and
+	// Edits holds its earlier versions, oldest first.
+	Edited  time.Time     `json:"edited,omitzero" schema:"readonly"`
+	Edits   []messageEdit `json:"edits,omitempty" schema:"readonly"`
+	Deleted bool          `json:"deleted,omitempty" schema:"readonly"`
+
+	// Reactions maps each emoji to the users who reacted with it.
+	Reactions map[string][]string `json:"reactions,omitempty" schema:"readonly"`
+}
+
+func (m messageArgs) validate() error {
+	if m.Message == "" {
+		return errors.New("message is empty")
+	}
+	if m.Private && m.Recipient == "" {
+		return errors.New("private message has no recipient")
+	}
+	return nil
+}
+
+// involves reports whether name sent or received the private message m.
+func (m messageArgs) involves(name string) bool {
+	return m.Private && (m.Sender == name || m.Recipient == name)
+}
+
+// nameSince is when c came to go by its name. Messages to or from the name
+// before then were someone else's. Registered accounts and bots never give
+// up their names, so for them it is the zero time.
+func nameSince(c Client) time.Time {
+	switch v := c.(type) {
+	case *connection:
+		return nameSince(v.owner())
+	case *webClient:
+		v.RLock()
+		defer v.RUnlock()
+		return v.since
+	}
+	return time.Time{}
+}
+
+// sentBy reports whether c, and not an earlier guest of the same name, is
+// the sender of msg.
+func sentBy(c Client, msg messageArgs) bool {
+	return msg.Sender == c.Name() && !msg.Time.Before(nameSince(c))
+}
+
+// historyArgs replays the recent messages of a room, and any private ones.
+type historyArgs struct {
+	Room     string        `json:"room"`
+	Messages []messageArgs `json:"messages"`
+}
+
+// renamedArgs tells the peers of a guest that it changed its name.
+type renamedArgs struct {
+	OldName string `json:"old_name"`
+	NewName string `json:"new_name"`
 }
 
 type commandToClient struct {
@@ -110,26 +691,38 @@ type commandToClient struct {
 	Args    interface{} `json:"args"`
 }
 
-var names = []string{
-	"picard",
-	"worf",
-	"data",
-	"barclay",
-	"troi",
-	"q",
-	"crusher",
-	"wesley",
-	"obrien",
-	"laforge",
-	"riker",
-	"borg",
-}
+// names are the crew names handed out to bots and guests.
+var names []string
+
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.#-]{0,23}$`)
 
 func randomName() string {
 	return names[rand.Intn(len(names))]
 }
 
-func (s *server) sendMessage(from Client, msg messageArgs) error {
+func validateName(name string) error {
+	if !namePattern.MatchString(name) {
+		return fmt.Errorf("invalid name %q", name)
+	}
+	return nil
+}
+
+func (s *server) nameTaken(name string) bool {
+	s.RLock()
+	defer s.RUnlock()
+	return s.clients[name] != nil
+}
+
+// nameAvailable reports whether a guest may use name. The caller must hold
+// the server lock.
+func (s *server) nameAvailable(name string) bool {
+	return s.clients[name] == nil && !s.users.exists(name) && s.bans.lookup(name, "") == nil
+}
+
+// sendMessage assigns msg an ID and timestamp and delivers it. A message
+// with a client key that from has already used is not sent again; the
+// original delivery is returned instead.
+func (s *server) sendMessage(from Client, msg *messageArgs) (d delivery, err error) {
 	s.Lock()
 	stats := s.clientStats[from.Name()]
 	if stats == nil {
@@ -138,31 +731,176 @@ func (s *server) sendMessage(from Client, msg messageArgs) error {
 	}
 	s.Unlock()
 
+	if b := s.bans.lookup(from.Name(), ""); b != nil {
+		return delivery{}, fmt.Errorf("you are banned: %s", b.Reason)
+	}
+
+	// Clients only pick what to say and to whom; everything else is
+	// filled in here.
+	key := msg.ClientKey
+	*msg = messageArgs{
+		Message:   msg.Message,
+		Private:   msg.Private,
+		Recipient: msg.Recipient,
+		Room:      msg.Room,
+		ReplyTo:   msg.ReplyTo,
+		Action:    msg.Action,
+		Sender:    msg.Sender,
+	}
+	if key != "" {
+		p, d, ok := s.clientKeys.reserve(from, key)
+		if ok {
+			d.Duplicate = true
+			return d, nil
+		}
+		defer func() {
+			if err != nil {
+				s.clientKeys.release(from, key, p)
+			} else {
+				s.clientKeys.record(p, d)
+			}
+		}()
+	}
+
+	if err := s.checkRate(from, stats, msg); err != nil {
+		return delivery{}, err
+	}
+
+	var recipient Client
 	if msg.Private {
-		stats.PrivateCount++
+		msg.Room = ""
 		s.RLock()
-		recipient := s.clients[msg.Recipient]
-		privateHook := s.privateHook
+		recipient = s.clients[msg.Recipient]
 		s.RUnlock()
 		if recipient == nil {
-			return fmt.Errorf("no such recipient %s", msg.Recipient)
+			return delivery{}, fmt.Errorf("no such recipient %s", msg.Recipient)
+		}
+	} else {
+		if msg.Room == "" {
+			msg.Room = defaultRoom
 		}
-		if privateHook != nil {
-			privateHook(from, msg)
+		if !s.inRoom(from.Name(), msg.Room) {
+			return delivery{}, fmt.Errorf("not in room %s", msg.Room)
 		}
-		return recipient.SendCommand("message", msg)
+	}
+	if msg.ReplyTo != 0 {
+		if err := s.threadReply(from, msg); err != nil {
+			return delivery{}, err
+		}
+	}
+	msg.Mentions = s.parseMentions(msg.Message)
+
+	msg.ID = atomic.AddInt64(&s.lastMessageID, 1)
+	msg.Time = time.Now().UTC()
+	d = delivery{
+		ID:        msg.ID,
+		ClientKey: key,
+		Time:      msg.Time,
+	}
+
+	if msg.Private {
+		stats.PrivateCount++
+		if err := recipient.SendCommand("message", *msg); err != nil {
+			return delivery{}, err
+		}
+		metrics.messages.inc("private")
+		s.events.publish(event{Type: "private", User: from.Name(), Target: msg.Recipient})
 	} else {
 		stats.BroadcastCount++
-		s.broadcastCommand(from, "message", msg)
+		d.Failed = s.broadcastCommand(msg.Room, from, "message", *msg)
+		metrics.messages.inc("broadcast")
+		s.events.publish(event{Type: "broadcast", User: from.Name(), Room: msg.Room})
+	}
+
+	if wc, ok := from.(*webClient); ok {
+		s.stopTyping(wc, msg)
+	}
+
+	// Bots talking to themselves, like the romulan, would soon push
+	// everything else out of the history.
+	_, person := from.(*webClient)
+	if person || !msg.Private || msg.Recipient != msg.Sender {
+		if err := s.history.Append(*msg); err != nil {
+			log.Printf("Failed recording message from %s: %s", from.Name(), err)
+		}
+	}
+	s.notifyMentions(*msg, msg.Mentions)
+	return d, nil
+}
+
+// checkRate applies the rate limits to msg, recording any penalty in stats.
+func (s *server) checkRate(from Client, stats *clientStats, msg *messageArgs) error {
+	kind := "broadcast"
+	if msg.Private {
+		kind = "private"
+	}
+
+	now := time.Now()
+	// Bots answer what people say, so anyone could get them penalized
+	// for flooding; only an admin's mute holds them back.
+	if _, person := from.(*webClient); !person {
+		return s.limiter.adminMuted(from, now)
+	}
+	v, err := s.limiter.check(from, kind, now)
+	if v == allowed {
 		return nil
 	}
+
+	s.Lock()
+	stats.RateLimitedCount++
+	switch v {
+	case muted:
+		stats.MuteCount++
+		stats.MutedUntil = now.Add(s.limiter.muteDuration).UTC()
+	case disconnected:
+		stats.FloodDisconnectCount++
+	}
+	s.Unlock()
+
+	switch v {
+	case muted:
+		log.Printf("Muted %s for flooding", from.Name())
+	case disconnected:
+		log.Printf("Disconnecting %s for flooding", from.Name())
+		from.SendCommand("error", &commandError{Message: err.Error()})
+		s.disconnect(from, websocket.ClosePolicyViolation, err.Error())
+	}
+	return err
+}
+
+// sendHistory replays the most recent messages posted to room, along with
+// c's own private conversations if private is set.
+func (s *server) sendHistory(c Client, room string, private bool) error {
+	name := c.Name()
+	since := nameSince(c)
+	msgs := s.history.Recent(historyReplay, func(msg messageArgs) bool {
+		if msg.Deleted {
+			return false
+		}
+		if msg.Private {
+			return private && msg.involves(name) && !msg.Time.Before(since)
+		}
+		return msg.Room == room
+	})
+	for i := range msgs {
+		msgs[i].FromMe = msgs[i].Sender == name
+	}
+	return c.SendCommand("history", historyArgs{Room: room, Messages: msgs})
 }
 
-func (s *server) broadcastCommand(sender Client, command string, args interface{}) {
+// broadcastCommand sends a command to every member of room except sender,
+// returning the names of any members it could not be queued for.
+func (s *server) broadcastCommand(room string, sender Client, command string, args interface{}) []string {
+	start := time.Now()
+	defer func() {
+		metrics.fanout.observe(time.Since(start))
+	}()
+
 	s.RLock()
 	defer s.RUnlock()
 
-	for _, c := range s.clients {
+	var failed []string
+	for _, c := range s.rooms[room] {
 		if c == sender {
 			continue
 		}
@@ -171,63 +909,219 @@ func (s *server) broadcastCommand(sender Client, command string, args interface{
 
 		if err != nil {
 			log.Printf("Failed sending message to %s: %s", c.Name(), err)
+			failed = append(failed, c.Name())
 		}
 	}
+	sort.Strings(failed)
+	return failed
 }
 
-func (s *server) addWebClient(conn *websocket.Conn) *webClient {
-	c := &webClient{conn: conn}
-
+// addWebClient registers conn for a client under the requested name, or a
+// generated one if requested is empty or already taken. Authenticated
+// clients always get their account name, joining the client already
+// connected under it if there is one.
+func (s *server) addWebClient(conn *websocket.Conn, requested string, authenticated bool) (*connection, error) {
 	var name string
 
 	s.Lock()
+	if s.shuttingDown {
+		s.Unlock()
+		return nil, errShuttingDown
+	}
+	var existing *webClient
+	if authenticated && s.clients[requested] != nil {
+		wc, ok := s.clients[requested].(*webClient)
+		if !ok {
+			s.Unlock()
+			return nil, fmt.Errorf("%s is already connected", requested)
+		}
+		existing = wc
+	}
+
+	c := newConnection(conn)
+	s.conns.Add(1)
 	defer func() {
 		if s.clientStats[name] == nil {
-			s.clientStats[name] = &clientStats{}
+			stats := &clientStats{}
+			if authenticated {
+				*stats, _ = s.users.stats(name)
+			}
+			s.clientStats[name] = stats
 		}
 		s.clientStats[name].ConnectionCount++
 		s.Unlock()
-		s.broadcastUsers()
 	}()
 
+	if existing != nil {
+		name = requested
+		c.attach(existing)
+		return c, nil
+	}
+
+	wc := newWebClient(c.addr)
+	wc.authenticated = authenticated
+	if !authenticated {
+		wc.since = time.Now()
+	}
+	c.attach(wc)
+
+	if authenticated || (requested != "" && s.nameAvailable(requested)) {
+		name = requested
+		wc.name = name
+		s.clients[name] = wc
+		return c, nil
+	}
+
 	for i := 0; i < 100; i++ {
 		name = randomName()
-		if s.clients[name] == nil {
-			c.name = name
-			s.clients[name] = c
-			return c
+		if s.nameAvailable(name) {
+			wc.name = name
+			s.clients[name] = wc
+			return c, nil
 		}
 	}
 
 	for {
 		name = fmt.Sprintf("cadet#%d", rand.Intn(10000))
-		if s.clients[name] == nil {
-			c.name = name
-			s.clients[name] = c
-			return c
+		if s.nameAvailable(name) {
+			wc.name = name
+			s.clients[name] = wc
+			return c, nil
+		}
+	}
+}
+
+// attach makes c one of wc's connections, not yet welcomed.
+func (c *connection) attach(wc *webClient) {
+	c.Lock()
+	c.client = wc
+	c.Unlock()
+	wc.Lock()
+	wc.conns[c] = false
+	wc.Unlock()
+}
+
+// renameClient moves c to newName in clients, clientStats and every room it
+// is in, then tells its rooms about the change.
+func (s *server) renameClient(c *webClient, newName string) error {
+	if err := validateName(newName); err != nil {
+		return err
+	}
+	if c.authenticated {
+		return errors.New("registered users cannot change their name")
+	}
+
+	s.Lock()
+	oldName := c.Name()
+	if !s.nameAvailable(newName) {
+		s.Unlock()
+		return fmt.Errorf("name %s is taken", newName)
+	}
+
+	delete(s.clients, oldName)
+	s.clients[newName] = c
+
+	if stats := s.clientStats[oldName]; stats != nil {
+		delete(s.clientStats, oldName)
+		s.clientStats[newName] = stats
+	}
+
+	var rooms []string
+	peers := make(map[string]Client)
+	for room, members := range s.rooms {
+		if members[oldName] == nil {
+			continue
+		}
+		delete(members, oldName)
+		members[newName] = c
+		rooms = append(rooms, room)
+		for name, member := range members {
+			peers[name] = member
 		}
 	}
+	peers[newName] = c
+
+	c.setName(newName)
+	s.Unlock()
+
+	log.Printf("User %s renamed to %s", oldName, newName)
+	s.events.publish(event{Type: "rename", User: oldName, Target: newName})
+
+	args := renamedArgs{OldName: oldName, NewName: newName}
+	for _, peer := range peers {
+		if err := peer.SendCommand("renamed", args); err != nil {
+			log.Printf("Failed sending rename to %s: %s", peer.Name(), err)
+		}
+	}
+	for _, room := range rooms {
+		s.broadcastUsers(room)
+	}
+	return nil
 }
 
 func (s *server) removeClient(name string) {
 	s.Lock()
+	c := s.clients[name]
 	delete(s.clients, name)
+	rooms := s.leaveAllRooms(name)
 	s.Unlock()
 
-	s.broadcastUsers()
+	if c != nil {
+		s.limiter.forget(c, time.Now())
+		s.clientKeys.forget(c)
+	}
+
+	for _, room := range rooms {
+		s.broadcastUsers(room)
+	}
+}
+
+// removeConnection drops c from its client, and the client from the server
+// if c was its last connection, which it reports.
+func (s *server) removeConnection(c *connection) bool {
+	wc := c.client
+
+	s.Lock()
+	wc.Lock()
+	delete(wc.conns, c)
+	last := len(wc.conns) == 0
+	name := wc.name
+	wc.Unlock()
+
+	var rooms []string
+	if last && s.clients[name] == wc {
+		delete(s.clients, name)
+		rooms = s.leaveAllRooms(name)
+	}
+	s.Unlock()
+
+	if last {
+		s.limiter.forget(wc, time.Now())
+		s.clientKeys.forget(wc)
+	}
+
+	for _, room := range rooms {
+		s.broadcastUsers(room)
+	}
+	return last
+}
+
+// broadcastUsers sends the member list of room to everyone in it.
+func (s *server) broadcastUsers(room string) {
+	s.broadcastCommand(room, nil, "users", s.usersIn(room))
 }
 
-func (s *server) broadcastUsers() {
-	var users []string
+func (s *server) usersIn(room string) usersArgs {
+	var users []userInfo
 	s.RLock()
-	for _, c := range s.clients {
-		users = append(users, c.Name())
+	for _, c := range s.rooms[room] {
+		users = append(users, userInfoOf(c))
 	}
 	s.RUnlock()
-	sort.Strings(users)
-	s.broadcastCommand(nil, "users", map[string]interface{}{
-		"users": users,
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Name < users[j].Name
 	})
+	return usersArgs{Room: room, Users: users}
 }
 
 var enhancements = map[string][]string{
@@ -1,86 +1,249 @@
 package main
 
 import (
-	"encoding/json"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
 )
 
+type nameArgs struct {
+	Name string `json:"name" schema:"required"`
+}
+
+func (a nameArgs) validate() error {
+	return validateName(a.Name)
+}
+
 func (s *server) handleConnect(w http.ResponseWriter, r *http.Request) {
+	var (
+		requested     = r.URL.Query().Get("name")
+		authenticated bool
+	)
+	if token := requestToken(r); token != "" {
+		name, ok := s.sessions.lookup(token)
+		if ok {
+			requested, authenticated = name, true
+		} else if r.URL.Query().Get("token") != "" {
+			// A stale cookie falls back to a guest connection, but an
+			// explicitly passed token must be valid.
+			http.Error(w, "invalid or expired session", http.StatusUnauthorized)
+			return
+		}
+	}
+	if !authenticated && requested != "" {
+		if err := validateName(requested); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if s.users.exists(requested) {
+			http.Error(w, "name "+requested+" is registered", http.StatusConflict)
+			return
+		}
+	}
+	addr, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if b := s.bans.lookup(requested, addr); b != nil {
+		http.Error(w, "banned: "+b.Reason, http.StatusForbidden)
+		return
+	}
+	if s.isShuttingDown() {
+		http.Error(w, errShuttingDown.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if !authenticated && requested != "" && s.nameTaken(requested) && !s.resumesName(r, requested) {
+		http.Error(w, "name "+requested+" is taken", http.StatusConflict)
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("error making websocket: %s", err)
+		atomic.AddInt64(&metrics.upgradeErrors, 1)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	sender := s.addWebClient(conn)
-
-	log.Printf("User %s connected", sender.name)
-
-	defer func() {
-		log.Printf("User %s disconnected", sender.name)
-		s.removeClient(sender.Name())
-	}()
-
-	err = sender.SendCommand("welcome", map[string]interface{}{
-		"name": sender.name,
-	})
+	sender, err := s.addWebClient(conn, requested, authenticated)
 	if err != nil {
-		log.Printf("Error sending welcome command: %s", err)
+		log.Printf("error adding client: %s", err)
+		conn.Close()
 		return
 	}
 
-	var enhanceCount int
+	log.Printf("User %s connected", sender.Name())
+	s.events.publish(event{Type: "connect", User: sender.Name(), Detail: sender.addr})
 
-	for {
-		var (
-			command         commandFromClient
-			responseCommand string
-			responseArgs    interface{}
-			message         messageArgs
-		)
-
-		if err := conn.ReadJSON(&command); err != nil {
-			log.Printf("error reading command: %s", err)
+	var readErr error
+	defer func() {
+		sender.close(websocket.CloseNormalClosure, "")
+		// Wait out a welcome in progress, and stop any to come, so the
+		// client is not put back in a room once removed.
+		sender.welcomeOnce.Do(func() {})
+		if sender.dropped(readErr) && s.awaitResume(sender) {
+			s.conns.Done()
 			return
 		}
+		s.Lock()
+		s.revokeResumeToken(sender)
+		s.Unlock()
 
-		switch command.Command {
-		case "send_message":
-			if err := json.Unmarshal(command.Args, &message); err != nil {
-				log.Printf("error unmarshaling message args: %s", err)
-				return
-			}
-
-			message.Sender = sender.name
+		log.Printf("User %s disconnected", sender.Name())
+		s.events.publish(event{Type: "disconnect", User: sender.Name(), Detail: sender.addr})
+		if s.removeConnection(sender) && sender.client.authenticated {
+			s.saveAccountStats(sender.Name())
+		}
+		s.conns.Done()
+	}()
 
-			if rand.Intn(2) == 0 {
-				enhanceMessage(sender.name, &message, enhanceCount)
-				enhanceCount++
-			}
+	// Clients that don't say hello first speak version 1.
+	timer := time.AfterFunc(helloTimeout, func() {
+		s.welcome(sender, nil)
+	})
+	defer timer.Stop()
 
-			err := s.sendMessage(sender, message)
-			if err != nil {
-				responseCommand = "error"
-				responseArgs = map[string]string{
-					"message": err.Error(),
+	for {
+		var command commandFromClient
+		if readErr = sender.readCommand(&command); readErr != nil {
+			if ce, ok := readErr.(*commandError); ok {
+				readErr = nil
+				s.events.publish(event{Type: "error", User: sender.Name(), Detail: ce.Message})
+				if err := sender.SendCommand("error", ce); err != nil {
+					log.Printf("error writing response: %s", err)
+					return
 				}
-				break
+				continue
 			}
-
-			responseCommand = "message"
-			message.FromMe = true
-			responseArgs = message
-		default:
-			log.Printf("unknown command: %s", command.Command)
+			log.Printf("error reading command: %s", readErr)
 			return
 		}
 
-		if err := sender.SendCommand(responseCommand, responseArgs); err != nil {
+		if command.Command != "hello" && command.Command != "resume" {
+			s.welcome(sender, nil)
+		}
+		reply, args, err := s.dispatch(sender, command)
+		if err != nil {
+			s.events.publish(event{Type: "error", User: sender.Name(), Detail: err.Error()})
+			reply, args = "error", err
+		}
+		if reply == "" {
+			continue
+		}
+
+		if err := sender.SendCommand(reply, args); err != nil {
 			log.Printf("error writing response: %s", err)
 			return
 		}
 	}
 }
+
+// The handlers below act for c's client, so what they change, such as the
+// rooms it is in, is sent to all its connections. Replies and slash command
+// output go to c alone.
+
+func (s *server) cmdSendMessage(c *connection, msg *messageArgs) (string, interface{}, error) {
+	msg.Sender = c.Name()
+	key := msg.ClientKey
+
+	if strings.HasPrefix(msg.Message, "/") {
+		send, err := s.slashCommand(c, msg)
+		if err != nil || !send {
+			return "", nil, err
+		}
+	}
+
+	if rand.Intn(2) == 0 {
+		c.client.Lock()
+		count := c.client.enhanceCount
+		c.client.enhanceCount++
+		c.client.Unlock()
+		enhanceMessage(msg.Sender, msg, count)
+	}
+
+	d, err := s.sendMessage(c.client, msg)
+	if err != nil {
+		return "", nil, &commandError{Message: err.Error(), ClientKey: key}
+	}
+
+	if !d.Duplicate {
+		c.client.Lock()
+		c.client.lastSent = d.ID
+		c.client.Unlock()
+		msg.FromMe = true
+		if err := c.client.SendCommand("message", *msg); err != nil {
+			return "", nil, err
+		}
+	}
+	return "ack", d, nil
+}
+
+func (s *server) cmdJoinRoom(c *connection, args *roomArgs) (string, interface{}, error) {
+	if err := s.joinRoom(c.client, args.Room); err != nil {
+		return "", nil, err
+	}
+	if err := s.sendHistory(c.client, args.Room, false); err != nil {
+		return "", nil, err
+	}
+	return "", nil, c.client.SendCommand("joined_room", args)
+}
+
+func (s *server) cmdLeaveRoom(c *connection, args *roomArgs) (string, interface{}, error) {
+	if err := s.leaveRoom(c.client, args.Room); err != nil {
+		return "", nil, err
+	}
+	return "", nil, c.client.SendCommand("left_room", args)
+}
+
+func (s *server) cmdListRooms(c *connection, args *noArgs) (string, interface{}, error) {
+	return "rooms", roomsArgs{Rooms: s.listRooms()}, nil
+}
+
+func (s *server) cmdSetName(c *connection, args *nameArgs) (string, interface{}, error) {
+	return "", nil, s.renameClient(c.client, args.Name)
+}
+
+func (s *server) cmdSetPresence(c *connection, args *presenceArgs) (string, interface{}, error) {
+	return "", nil, s.setPresence(c.client, args.Presence)
+}
+
+func (s *server) cmdTyping(c *connection, args *typingArgs) (string, interface{}, error) {
+	return "", nil, s.setTyping(c.client, *args)
+}
+
+func (s *server) cmdEditMessage(c *connection, args *editArgs) (string, interface{}, error) {
+	return "", nil, s.editMessage(c.client, *args)
+}
+
+func (s *server) cmdDeleteMessage(c *connection, args *messageIDArgs) (string, interface{}, error) {
+	return "", nil, s.deleteMessage(c.client, args.ID)
+}
+
+func (s *server) cmdGetThread(c *connection, args *messageIDArgs) (string, interface{}, error) {
+	msgs, err := s.thread(c.client, args.ID)
+	if err != nil {
+		return "", nil, err
+	}
+	return "thread", threadArgs{ID: args.ID, Messages: msgs}, nil
+}
+
+func reactCommand(add bool) commandHandler[reactionArgs] {
+	return func(s *server, c *connection, args *reactionArgs) (string, interface{}, error) {
+		return "", nil, s.react(c.client, *args, add)
+	}
+}
+
+func moderationCommand(action string) commandHandler[moderationArgs] {
+	return func(s *server, c *connection, args *moderationArgs) (string, interface{}, error) {
+		if !s.isAdmin(c.client) {
+			return "", nil, errNotAdmin
+		}
+		if err := s.moderate(c.Name(), action, *args); err != nil {
+			return "", nil, err
+		}
+		return "moderated", moderatedArgs{Action: action, Name: args.Name}, nil
+	}
+}
@@ -0,0 +1,400 @@
+// Copyright (c) 2016, RetailNext, Inc.
+// This material contains trade secrets and confidential information of
+// RetailNext, Inc.  Any use, reproduction, disclosure or dissemination
+// is strictly prohibited without the explicit written permission
+// of RetailNext, Inc.
+// All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config holds every tunable of the server. Values come from the defaults
+// below, then the JSON file named by -config, then TREKCHAT_* environment
+// variables and finally command line flags. Each field's flag and
+// environment variable are derived from its json tag, so "ping_interval"
+// is set by -ping-interval and TREKCHAT_PING_INTERVAL.
+type config struct {
+	Listen      string `json:"listen"`
+	DebugListen string `json:"debug_listen"`
+	StaticDir   string `json:"static_dir"`
+	HistoryFile string `json:"history_file"`
+	UsersFile   string `json:"users_file"`
+	BansFile    string `json:"bans_file"`
+	AuditFile   string `json:"audit_file"`
+
+	Admins []string `json:"admins"`
+
+	ReadBufferSize  int            `json:"read_buffer_size"`
+	WriteBufferSize int            `json:"write_buffer_size"`
+	QueueSize       int            `json:"queue_size"`
+	OverflowPolicy  overflowPolicy `json:"overflow_policy"`
+	WriteTimeout    duration       `json:"write_timeout"`
+	PingInterval    duration       `json:"ping_interval"`
+	PongWait        duration       `json:"pong_wait"`
+	IdleTimeout     duration       `json:"idle_timeout"`
+	ResumeGrace     duration       `json:"resume_grace"`
+	ShutdownTimeout duration       `json:"shutdown_timeout"`
+
+	BroadcastRate     float64  `json:"broadcast_rate"`
+	BroadcastBurst    int      `json:"broadcast_burst"`
+	PrivateRate       float64  `json:"private_rate"`
+	PrivateBurst      int      `json:"private_burst"`
+	StrikesToMute     int      `json:"strikes_to_mute"`
+	MuteDuration      duration `json:"mute_duration"`
+	MutesToDisconnect int      `json:"mutes_to_disconnect"`
+
+	BotMinDelay duration    `json:"bot_min_delay"`
+	BotMaxDelay duration    `json:"bot_max_delay"`
+	Names       []string    `json:"names"`
+	Bots        []botConfig `json:"bots"`
+}
+
+var configUsage = map[string]string{
+	"listen":              "address to serve chat on",
+	"debug_listen":        "address to serve debug handlers on",
+	"static_dir":          "directory of static web files",
+	"history_file":        "append chat history to this file and replay it on startup",
+	"users_file":          "persist registered accounts to this file",
+	"bans_file":           "persist bans to this file",
+	"audit_file":          "append moderation actions to this file",
+	"admins":              "comma separated registered accounts allowed to moderate",
+	"read_buffer_size":    "websocket read buffer size",
+	"write_buffer_size":   "websocket write buffer size",
+	"queue_size":          "outbound commands buffered per websocket",
+	"overflow_policy":     "what to do when a websocket's queue is full: drop-oldest, drop-newest or disconnect",
+	"write_timeout":       "deadline for writing a command to a websocket",
+	"ping_interval":       "how often to ping websockets",
+	"pong_wait":           "disconnect websockets that send nothing, not even a pong, for this long",
+	"idle_timeout":        "disconnect websockets that send no commands for this long, 0 to never",
+	"resume_grace":        "how long a dropped client keeps its name waiting to be resumed, 0 to never",
+	"shutdown_timeout":    "how long to wait for connections to drain on shutdown",
+	"broadcast_rate":      "room messages per second allowed per client",
+	"broadcast_burst":     "room messages a client may send in a burst",
+	"private_rate":        "private messages per second allowed per client",
+	"private_burst":       "private messages a client may send in a burst",
+	"strikes_to_mute":     "refused messages before a client is muted",
+	"mute_duration":       "how long a flooding client stays muted",
+	"mutes_to_disconnect": "disconnect a client that floods after being muted this many times",
+	"bot_min_delay":       "shortest pause between bot messages",
+	"bot_max_delay":       "longest pause between bot messages",
+	"names":               "comma separated crew names handed out to guests",
+	"bots":                "JSON list of bots to run",
+}
+
+func defaultConfig() *config {
+	c := &config{
+		Listen:            ":8080",
+		DebugListen:       "localhost:8081",
+		StaticDir:         "static",
+		ReadBufferSize:    1024,
+		WriteBufferSize:   1024,
+		QueueSize:         256,
+		OverflowPolicy:    dropOldest,
+		WriteTimeout:      duration{10 * time.Second},
+		PingInterval:      duration{30 * time.Second},
+		PongWait:          duration{60 * time.Second},
+		ResumeGrace:       duration{2 * time.Minute},
+		ShutdownTimeout:   duration{10 * time.Second},
+		BroadcastRate:     1,
+		BroadcastBurst:    5,
+		PrivateRate:       2,
+		PrivateBurst:      10,
+		StrikesToMute:     5,
+		MuteDuration:      duration{30 * time.Second},
+		MutesToDisconnect: 2,
+		BotMinDelay:       duration{5 * time.Second},
+		BotMaxDelay:       duration{35 * time.Second},
+		Names: []string{
+			"picard",
+			"worf",
+			"data",
+			"barclay",
+			"troi",
+			"q",
+			"crusher",
+			"wesley",
+			"obrien",
+			"laforge",
+			"riker",
+			"borg",
+		},
+	}
+	c.Bots = defaultBots(c.Names)
+	return c
+}
+
+// duration is a time.Duration that reads and writes strings like "30s".
+type duration struct {
+	time.Duration
+}
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (p overflowPolicy) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *overflowPolicy) UnmarshalText(text []byte) error {
+	return p.Set(string(text))
+}
+
+// setField parses value into the config field with the given json name.
+func (c *config) setField(name, value string) error {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("json") != name {
+			continue
+		}
+
+		field := v.Field(i)
+		if u, ok := field.Addr().Interface().(interface {
+			UnmarshalText([]byte) error
+		}); ok {
+			return u.UnmarshalText([]byte(value))
+		}
+
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return err
+			}
+			field.SetInt(int64(n))
+		case reflect.Float64:
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return err
+			}
+			field.SetFloat(f)
+		case reflect.Slice:
+			if field.Type().Elem().Kind() != reflect.String {
+				return json.Unmarshal([]byte(value), field.Addr().Interface())
+			}
+			var items []string
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			field.Set(reflect.ValueOf(items))
+		default:
+			return fmt.Errorf("unsupported config field %s", name)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown config field %s", name)
+}
+
+func (c *config) fieldNames() []string {
+	var names []string
+	t := reflect.TypeOf(*c)
+	for i := 0; i < t.NumField(); i++ {
+		names = append(names, t.Field(i).Tag.Get("json"))
+	}
+	return names
+}
+
+func (c *config) fieldString(name string) string {
+	data, _ := json.Marshal(c)
+	var fields map[string]interface{}
+	json.Unmarshal(data, &fields)
+	switch v := fields[name].(type) {
+	case []interface{}:
+		var items []string
+		for _, item := range v {
+			if _, ok := item.(string); !ok {
+				return ""
+			}
+			items = append(items, fmt.Sprint(item))
+		}
+		return strings.Join(items, ",")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// flagValue records a flag's value so it can be applied after the config
+// file and environment.
+type flagValue struct {
+	def string
+	set *string
+}
+
+func (f flagValue) String() string {
+	return f.def
+}
+
+func (f flagValue) Set(value string) error {
+	*f.set = value
+	return nil
+}
+
+var (
+	configFile  = flag.String("config", "", "JSON config file")
+	configFlags = make(map[string]*string)
+)
+
+func init() {
+	def := defaultConfig()
+	for _, name := range def.fieldNames() {
+		value := new(string)
+		configFlags[name] = value
+		flag.Var(flagValue{def.fieldString(name), value}, strings.Replace(name, "_", "-", -1), configUsage[name])
+	}
+}
+
+// loadConfig builds the config from the defaults, the config file, the
+// environment and the flags set on the command line. It must be called
+// after flag.Parse.
+func loadConfig() (*config, error) {
+	c := defaultConfig()
+
+	if *configFile != "" {
+		data, err := os.ReadFile(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(c); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %s", *configFile, err)
+		}
+	}
+
+	for _, name := range c.fieldNames() {
+		env := "TREKCHAT_" + strings.ToUpper(name)
+		if value, ok := os.LookupEnv(env); ok {
+			if err := c.setField(name, value); err != nil {
+				return nil, fmt.Errorf("invalid %s: %s", env, err)
+			}
+		}
+	}
+
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		name := strings.Replace(f.Name, "-", "_", -1)
+		value := configFlags[name]
+		if value == nil || err != nil {
+			return
+		}
+		if setErr := c.setField(name, *value); setErr != nil {
+			err = fmt.Errorf("invalid -%s: %s", f.Name, setErr)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return c, c.validate()
+}
+
+func (c *config) validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.Listen != "", "listen must be set")
+	check(c.DebugListen != "", "debug_listen must be set")
+	if info, err := os.Stat(c.StaticDir); err != nil || !info.IsDir() {
+		problems = append(problems, fmt.Sprintf("static_dir %q is not a directory", c.StaticDir))
+	}
+	check(c.ReadBufferSize > 0, "read_buffer_size must be positive")
+	check(c.WriteBufferSize > 0, "write_buffer_size must be positive")
+	check(c.QueueSize > 0, "queue_size must be positive")
+	check(c.WriteTimeout.Duration > 0, "write_timeout must be positive")
+	check(c.PingInterval.Duration > 0 && c.PingInterval.Duration < c.PongWait.Duration,
+		"ping_interval %s must be positive and shorter than pong_wait %s", c.PingInterval, c.PongWait)
+	check(c.IdleTimeout.Duration >= 0, "idle_timeout must not be negative")
+	check(c.ResumeGrace.Duration >= 0, "resume_grace must not be negative")
+	check(c.ShutdownTimeout.Duration > 0, "shutdown_timeout must be positive")
+	check(c.BroadcastRate > 0 && c.BroadcastBurst > 0, "broadcast_rate and broadcast_burst must be positive")
+	check(c.PrivateRate > 0 && c.PrivateBurst > 0, "private_rate and private_burst must be positive")
+	check(c.StrikesToMute > 0, "strikes_to_mute must be positive")
+	check(c.MuteDuration.Duration > 0, "mute_duration must be positive")
+	check(c.MutesToDisconnect >= 0, "mutes_to_disconnect must not be negative")
+	check(c.BotMinDelay.Duration > 0 && c.BotMinDelay.Duration <= c.BotMaxDelay.Duration,
+		"bot_min_delay %s must be positive and no longer than bot_max_delay %s", c.BotMinDelay, c.BotMaxDelay)
+	check(len(c.Names) > 0, "names must not be empty")
+	seen := make(map[string]bool)
+	for _, name := range c.Names {
+		check(validateName(name) == nil, "invalid name %q", name)
+		check(!seen[name], "duplicate name %q", name)
+		seen[name] = true
+	}
+	for _, admin := range c.Admins {
+		check(validateName(admin) == nil, "invalid admin %q", admin)
+	}
+	bots := make(map[string]bool)
+	for _, b := range c.Bots {
+		if err := b.validate(); err != nil {
+			problems = append(problems, err.Error())
+		}
+		check(!bots[b.Name], "duplicate bot %q", b.Name)
+		bots[b.Name] = true
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid config: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// apply installs the config's connection settings.
+func (c *config) apply() {
+	upgrader.ReadBufferSize = c.ReadBufferSize
+	upgrader.WriteBufferSize = c.WriteBufferSize
+	outboundQueueSize = c.QueueSize
+	outboundOverflow = c.OverflowPolicy
+	writeTimeout = c.WriteTimeout.Duration
+	pingInterval = c.PingInterval.Duration
+	pongWait = c.PongWait.Duration
+	idleTimeout = c.IdleTimeout.Duration
+	resumeGrace = c.ResumeGrace.Duration
+	names = c.Names
+}
+
+func (s *server) debugConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "config is read-only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	data, err := json.MarshalIndent(s.config, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+	fmt.Fprintln(w)
+}
@@ -12,7 +12,6 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
-	"time"
 )
 
 func (s *server) debugStatus(w http.ResponseWriter, r *http.Request) {
@@ -34,6 +33,19 @@ func (s *server) debugUser(w http.ResponseWriter, r *http.Request) {
 	pathParts := strings.Split(r.URL.Path, "/")
 	name := pathParts[len(pathParts)-1]
 
+	if r.Method == "DELETE" {
+		err := s.moderate("debug:"+r.RemoteAddr, "ban", moderationArgs{
+			Name:   name,
+			Reason: "black-listed",
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "%q black-listed\n", name)
+		return
+	}
+
 	s.RLock()
 	_, ok := s.clients[name]
 	stats := s.clientStats[name]
@@ -46,32 +58,25 @@ func (s *server) debugUser(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
 		encoder := json.NewEncoder(w)
 		encoder.Encode(stats)
-	} else if r.Method == "DELETE" {
-		s.removeClient(name)
-		fmt.Fprintf(w, "%q black-listed\n", name)
 	}
 }
 
-func (s *server) debugPrivate(w http.ResponseWriter, r *http.Request) {
-	done := make(chan struct{})
+// debugBlacklist lists black-listed names on GET /debug/chat/blacklist/ and
+// lifts one on DELETE /debug/chat/blacklist/<name>. Black-listing is a
+// permanent ban, so these are the same entries as /debug/chat/bans.
+func (s *server) debugBlacklist(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/debug/chat/blacklist/")
 
-	s.Lock()
-	s.privateHook = func(from Client, msg messageArgs) {
-		_, err := fmt.Fprintf(w, "%s private message from %q to %q\n", time.Now().UTC().Format(time.RFC3339), from.Name(), msg.Recipient)
-		if err != nil {
-			select {
-			case done <- struct{}{}:
-			default:
-			}
+	switch {
+	case r.Method == "GET" && name == "":
+		s.debugBans(w, r)
+	case r.Method == "DELETE" && name != "":
+		if err := s.moderate("debug:"+r.RemoteAddr, "unban", moderationArgs{Name: name}); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
 		}
+		fmt.Fprintf(w, "%q removed from black-list\n", name)
+	default:
+		http.Error(w, "expected GET /debug/chat/blacklist/ or DELETE /debug/chat/blacklist/<name>", http.StatusMethodNotAllowed)
 	}
-	s.Unlock()
-
-	defer func() {
-		s.Lock()
-		s.privateHook = nil
-		s.Unlock()
-	}()
-
-	<-done
 }
@@ -0,0 +1,118 @@
+// Copyright (c) 2016, RetailNext, Inc.
+// This material contains trade secrets and confidential information of
+// RetailNext, Inc.  Any use, reproduction, disclosure or dissemination
+// is strictly prohibited without the explicit written permission
+// of RetailNext, Inc.
+// All rights reserved.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// clientKeysPerUser is how many idempotency keys are remembered for each
+// sender.
+const clientKeysPerUser = 100
+
+// delivery is what the sender of a message is told in its ack.
+type delivery struct {
+	ID        int64     `json:"id"`
+	ClientKey string    `json:"client_key,omitempty"`
+	Time      time.Time `json:"time"`
+	// Failed lists the recipients the message could not be queued for.
+	Failed []string `json:"failed,omitempty"`
+	// Duplicate is set when ClientKey was already used, in which case the
+	// message was not sent again and the original delivery is returned.
+	Duplicate bool `json:"duplicate,omitempty"`
+}
+
+// clientKeys remembers the deliveries of the most recent messages each
+// sender tagged with an idempotency key, so a message resent after a
+// reconnect is only delivered once. Senders are told apart by identity
+// rather than name, which a guest can give up for another to take.
+type clientKeys struct {
+	sync.Mutex
+	clients map[Client]*senderKeys
+}
+
+type senderKeys struct {
+	order   []string
+	pending map[string]*pendingKey
+}
+
+// pendingKey is a key claimed for a message, whose delivery is set, with
+// sent, before done is closed.
+type pendingKey struct {
+	done chan struct{}
+	d    delivery
+	sent bool
+}
+
+func newClientKeys() *clientKeys {
+	return &clientKeys{clients: make(map[Client]*senderKeys)}
+}
+
+// reserve claims key for a message from sender, to be passed to record
+// once the message is sent or to release if it is not. If sender already
+// used key, reserve waits for that message instead and returns its
+// delivery with ok set.
+func (ck *clientKeys) reserve(sender Client, key string) (p *pendingKey, d delivery, ok bool) {
+	for {
+		ck.Lock()
+		sk := ck.clients[sender]
+		if sk == nil {
+			sk = &senderKeys{pending: make(map[string]*pendingKey)}
+			ck.clients[sender] = sk
+		}
+		p = sk.pending[key]
+		if p == nil {
+			p = &pendingKey{done: make(chan struct{})}
+			sk.pending[key] = p
+			sk.order = append(sk.order, key)
+			if len(sk.order) > clientKeysPerUser {
+				delete(sk.pending, sk.order[0])
+				sk.order = sk.order[1:]
+			}
+			ck.Unlock()
+			return p, delivery{}, false
+		}
+		ck.Unlock()
+
+		<-p.done
+		if p.sent {
+			return nil, p.d, true
+		}
+		// The message was not sent, so this one may take the key.
+	}
+}
+
+// record sets the delivery of the message p was reserved for.
+func (ck *clientKeys) record(p *pendingKey, d delivery) {
+	p.d, p.sent = d, true
+	close(p.done)
+}
+
+// release gives up the key p was reserved for, its message not sent.
+func (ck *clientKeys) release(sender Client, key string, p *pendingKey) {
+	ck.Lock()
+	if sk := ck.clients[sender]; sk != nil && sk.pending[key] == p {
+		delete(sk.pending, key)
+		for i, k := range sk.order {
+			if k == key {
+				sk.order = append(sk.order[:i], sk.order[i+1:]...)
+				break
+			}
+		}
+	}
+	ck.Unlock()
+	close(p.done)
+}
+
+// forget drops the keys of sender, which is gone.
+func (ck *clientKeys) forget(sender Client) {
+	ck.Lock()
+	delete(ck.clients, sender)
+	ck.Unlock()
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2016, RetailNext, Inc.
+// This material contains trade secrets and confidential information of
+// RetailNext, Inc.  Any use, reproduction, disclosure or dissemination
+// is strictly prohibited without the explicit written permission
+// of RetailNext, Inc.
+// All rights reserved.
+
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestClientKeysConcurrentResend(t *testing.T) {
+	ck := newClientKeys()
+	sender := &webClient{name: "sulu"}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		sent     int
+		resentAs []int64
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p, d, ok := ck.reserve(sender, "k1")
+			mu.Lock()
+			defer mu.Unlock()
+			if ok {
+				resentAs = append(resentAs, d.ID)
+				return
+			}
+			sent++
+			ck.record(p, delivery{ID: 42, ClientKey: "k1"})
+		}()
+	}
+	wg.Wait()
+
+	if sent != 1 {
+		t.Fatalf("sent %d times, want once", sent)
+	}
+	for _, id := range resentAs {
+		if id != 42 {
+			t.Errorf("resend got delivery %d, want 42", id)
+		}
+	}
+}
+
+func TestClientKeysRelease(t *testing.T) {
+	ck := newClientKeys()
+	sender := &webClient{name: "sulu"}
+
+	p, _, _ := ck.reserve(sender, "k1")
+	ck.release(sender, "k1", p)
+	if _, _, ok := ck.reserve(sender, "k1"); ok {
+		t.Fatal("key of an unsent message counted as used")
+	}
+
+	// Another client taking the name does not inherit the keys.
+	if _, _, ok := ck.reserve(&webClient{name: "sulu"}, "k1"); ok {
+		t.Fatal("key used by another client with the same name")
+	}
+}
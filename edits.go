@@ -0,0 +1,174 @@
+// Copyright (c) 2016, RetailNext, Inc.
+// This material contains trade secrets and confidential information of
+// RetailNext, Inc.  Any use, reproduction, disclosure or dissemination
+// is strictly prohibited without the explicit written permission
+// of RetailNext, Inc.
+// All rights reserved.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// messageEdit is an earlier version of an edited message.
+type messageEdit struct {
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+type editArgs struct {
+	ID      int64  `json:"id" schema:"required"`
+	Message string `json:"message" schema:"required"`
+}
+
+func (a editArgs) validate() error {
+	if a.ID == 0 {
+		return errors.New("no message id given")
+	}
+	if a.Message == "" {
+		return errors.New("cannot edit a message to be empty")
+	}
+	return nil
+}
+
+type deletedArgs struct {
+	ID      int64  `json:"id"`
+	Room    string `json:"room,omitempty"`
+	Private bool   `json:"private"`
+}
+
+// editMessage replaces the text of message id, keeping the old text in its
+// edit history, and tells everyone who can see the message. Users newly
+// mentioned by the edit are notified.
+func (s *server) editMessage(c Client, args editArgs) error {
+	mentions := s.parseMentions(args.Message)
+
+	var author string
+	var mentioned []string
+	msg, err := s.history.Update(args.ID, func(msg *messageArgs) error {
+		if err := s.canChange(c, *msg); err != nil {
+			return err
+		}
+		author = msg.Sender
+		mentioned = msg.Mentions
+		msg.Mentions = mentions
+		msg.Edits = append(msg.Edits, messageEdit{
+			Message: msg.Message,
+			Time:    msg.lastChanged(),
+		})
+		msg.Message = args.Message
+		msg.Edited = time.Now().UTC()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.auditChange(c, "edit_message", author, args.ID)
+	s.notifyAudience(msg, "message_edited", msg)
+
+	var added []string
+	for _, name := range mentions {
+		if indexOf(mentioned, name) < 0 {
+			added = append(added, name)
+		}
+	}
+	s.notifyMentions(msg, added)
+	return nil
+}
+
+// deleteMessage blanks message id, its edit history and its reactions,
+// leaving a tombstone in the store, and tells everyone who could see it.
+func (s *server) deleteMessage(c Client, id int64) error {
+	var author string
+	msg, err := s.history.Update(id, func(msg *messageArgs) error {
+		if err := s.canChange(c, *msg); err != nil {
+			return err
+		}
+		author = msg.Sender
+		msg.Message = ""
+		msg.Edits = nil
+		msg.Reactions = nil
+		msg.Deleted = true
+		msg.Edited = time.Now().UTC()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.auditChange(c, "delete_message", author, id)
+	s.notifyAudience(msg, "message_deleted", deletedArgs{
+		ID:      msg.ID,
+		Room:    msg.Room,
+		Private: msg.Private,
+	})
+	return nil
+}
+
+// canChange reports whether c may edit or delete msg.
+func (s *server) canChange(c Client, msg messageArgs) error {
+	if msg.Deleted {
+		return fmt.Errorf("message %d was deleted", msg.ID)
+	}
+	if !sentBy(c, msg) && !s.isAdmin(c) {
+		return errors.New("you can only change your own messages")
+	}
+	return nil
+}
+
+// auditChange records an admin changing someone else's message.
+func (s *server) auditChange(c Client, action, author string, id int64) {
+	if author == c.Name() {
+		return
+	}
+	log.Printf("%s: %s %d by %s", c.Name(), action, id, author)
+	s.audit.record(auditEntry{
+		Time:   time.Now().UTC(),
+		Actor:  c.Name(),
+		Action: action,
+		Target: author,
+		Reason: "message " + strconv.FormatInt(id, 10),
+	})
+}
+
+// notifyAudience sends a command about msg to both parties of a private
+// message, or to the members of the room it was posted in. A guest that
+// took a party's name since is not told.
+func (s *server) notifyAudience(msg messageArgs, command string, args interface{}) {
+	if !msg.Private {
+		s.broadcastCommand(msg.Room, nil, command, args)
+		return
+	}
+
+	s.RLock()
+	var audience []Client
+	for _, name := range []string{msg.Sender, msg.Recipient} {
+		if c := s.clients[name]; c != nil {
+			audience = append(audience, c)
+		}
+	}
+	s.RUnlock()
+
+	for _, c := range audience {
+		if !s.canSee(c, msg) {
+			continue
+		}
+		if err := c.SendCommand(command, args); err != nil {
+			log.Printf("Failed sending %s to %s: %s", command, c.Name(), err)
+		}
+	}
+}
+
+// lastChanged is when the current text of m was written.
+func (m messageArgs) lastChanged() time.Time {
+	if !m.Edited.IsZero() {
+		return m.Edited
+	}
+	return m.Time
+}
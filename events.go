@@ -0,0 +1,174 @@
+// Copyright (c) 2016, RetailNext, Inc.
+// This material contains trade secrets and confidential information of
+// RetailNext, Inc.  Any use, reproduction, disclosure or dissemination
+// is strictly prohibited without the explicit written permission
+// of RetailNext, Inc.
+// All rights reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const subscriberBuffer = 256
+
+var eventTypes = map[string]bool{
+	"connect":    true,
+	"disconnect": true,
+	"broadcast":  true,
+	"private":    true,
+	"error":      true,
+	"rename":     true,
+	"resume":     true,
+}
+
+// event describes something that happened on the server. Message text is
+// deliberately left out.
+type event struct {
+	Time   time.Time `json:"time"`
+	Type   string    `json:"type"`
+	User   string    `json:"user"`
+	Target string    `json:"target,omitempty"`
+	Room   string    `json:"room,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// eventFilter matches events of any of types, or of every type if types is
+// empty, that involve user, or anyone if user is empty.
+type eventFilter struct {
+	types map[string]bool
+	user  string
+}
+
+func (f eventFilter) match(e event) bool {
+	if len(f.types) > 0 && !f.types[e.Type] {
+		return false
+	}
+	return f.user == "" || e.User == f.user || e.Target == f.user
+}
+
+type subscriber struct {
+	filter  eventFilter
+	events  chan event
+	dropped int64
+}
+
+// eventBus fans events out to any number of subscribers. Publishing never
+// blocks; a subscriber that falls behind misses events.
+type eventBus struct {
+	sync.Mutex
+	subs map[*subscriber]struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: make(map[*subscriber]struct{})}
+}
+
+func (b *eventBus) subscribe(f eventFilter) *subscriber {
+	sub := &subscriber{
+		filter: f,
+		events: make(chan event, subscriberBuffer),
+	}
+	b.Lock()
+	b.subs[sub] = struct{}{}
+	b.Unlock()
+	return sub
+}
+
+func (b *eventBus) unsubscribe(sub *subscriber) {
+	b.Lock()
+	delete(b.subs, sub)
+	b.Unlock()
+}
+
+func (b *eventBus) publish(e event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	for sub := range b.subs {
+		if !sub.filter.match(e) {
+			continue
+		}
+		select {
+		case sub.events <- e:
+		default:
+			atomic.AddInt64(&sub.dropped, 1)
+		}
+	}
+}
+
+// debugEvents streams events as newline delimited JSON, or as server-sent
+// events when format=sse is given or the client accepts text/event-stream.
+// The type parameter takes a comma separated list of event types and user
+// limits the stream to events involving that user.
+func (s *server) debugEvents(w http.ResponseWriter, r *http.Request) {
+	filter := eventFilter{
+		types: make(map[string]bool),
+		user:  r.FormValue("user"),
+	}
+	if types := r.FormValue("type"); types != "" {
+		for _, t := range strings.Split(types, ",") {
+			if !eventTypes[t] {
+				http.Error(w, fmt.Sprintf("unknown event type %q", t), http.StatusBadRequest)
+				return
+			}
+			filter.types[t] = true
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	sse := r.FormValue("format") == "sse" || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	sub := s.events.subscribe(filter)
+	defer func() {
+		s.events.unsubscribe(sub)
+		if dropped := atomic.LoadInt64(&sub.dropped); dropped > 0 {
+			log.Printf("Event stream to %s dropped %d events", r.RemoteAddr, dropped)
+		}
+	}()
+
+	for {
+		select {
+		case e := <-sub.events:
+			data, err := json.Marshal(e)
+			if err != nil {
+				return
+			}
+			if sse {
+				_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+			} else {
+				_, err = fmt.Fprintf(w, "%s\n", data)
+			}
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
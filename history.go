@@ -0,0 +1,262 @@
+// Copyright (c) 2016, RetailNext, Inc.
+// This material contains trade secrets and confidential information of
+// RetailNext, Inc.  Any use, reproduction, disclosure or dissemination
+// is strictly prohibited without the explicit written permission
+// of RetailNext, Inc.
+// All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+const (
+	historyCapacity = 1000
+	historyReplay   = 50
+)
+
+// messageStore records messages so they can be replayed to clients
+// that connect later.
+type messageStore interface {
+	Append(msg messageArgs) error
+	// Recent returns up to n of the most recent messages for which
+	// visible returns true, oldest first.
+	Recent(n int, visible func(messageArgs) bool) []messageArgs
+	// Update applies change to the stored message with the given ID and
+	// returns the result. Nothing is stored if change returns an error.
+	Update(id int64, change func(*messageArgs) error) (messageArgs, error)
+	// Get returns the message with the given ID if it is still stored.
+	Get(id int64) (messageArgs, bool)
+	// Thread returns the stored replies in the thread started by message
+	// root, oldest first.
+	Thread(root int64) []messageArgs
+	Close() error
+}
+
+// memoryStore keeps the last capacity messages in a ring buffer.
+type memoryStore struct {
+	sync.Mutex
+	msgs []messageArgs
+	next int
+	full bool
+
+	// slots maps message IDs to their index in msgs, and threads maps the
+	// ID of the first message of each thread to the IDs of its replies.
+	slots   map[int64]int
+	threads map[int64][]int64
+}
+
+func newMemoryStore(capacity int) *memoryStore {
+	return &memoryStore{
+		msgs:    make([]messageArgs, capacity),
+		slots:   make(map[int64]int),
+		threads: make(map[int64][]int64),
+	}
+}
+
+func (m *memoryStore) Append(msg messageArgs) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if old := m.msgs[m.next]; old.ID != 0 {
+		delete(m.slots, old.ID)
+		m.unthread(old)
+	}
+	if msg.ID != 0 {
+		m.slots[msg.ID] = m.next
+	}
+	if msg.Thread != 0 {
+		m.threads[msg.Thread] = append(m.threads[msg.Thread], msg.ID)
+	}
+
+	m.msgs[m.next] = msg
+	m.next = (m.next + 1) % len(m.msgs)
+	if m.next == 0 {
+		m.full = true
+	}
+	return nil
+}
+
+func (m *memoryStore) Recent(n int, visible func(messageArgs) bool) []messageArgs {
+	m.Lock()
+	defer m.Unlock()
+
+	size := m.next
+	if m.full {
+		size = len(m.msgs)
+	}
+
+	var found []messageArgs
+	for i := 1; i <= size && len(found) < n; i++ {
+		msg := m.msgs[(m.next-i+len(m.msgs))%len(m.msgs)]
+		if visible(msg) {
+			found = append(found, msg)
+		}
+	}
+
+	for i, j := 0, len(found)-1; i < j; i, j = i+1, j-1 {
+		found[i], found[j] = found[j], found[i]
+	}
+	return found
+}
+
+func (m *memoryStore) Update(id int64, change func(*messageArgs) error) (messageArgs, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	i := m.find(id)
+	if i < 0 {
+		return messageArgs{}, fmt.Errorf("message %d not found", id)
+	}
+	msg := m.msgs[i]
+	if err := change(&msg); err != nil {
+		return messageArgs{}, err
+	}
+	m.msgs[i] = msg
+	return msg, nil
+}
+
+// find returns the index of the message with the given ID, or -1. The
+// caller must hold the lock.
+func (m *memoryStore) find(id int64) int {
+	if i, ok := m.slots[id]; ok {
+		return i
+	}
+	return -1
+}
+
+// unthread drops msg from the index of its thread. The caller must hold the
+// lock.
+func (m *memoryStore) unthread(msg messageArgs) {
+	if msg.Thread == 0 {
+		return
+	}
+	replies := m.threads[msg.Thread]
+	for i, id := range replies {
+		if id == msg.ID {
+			replies = append(replies[:i:i], replies[i+1:]...)
+			break
+		}
+	}
+	if len(replies) == 0 {
+		delete(m.threads, msg.Thread)
+	} else {
+		m.threads[msg.Thread] = replies
+	}
+}
+
+func (m *memoryStore) Get(id int64) (messageArgs, bool) {
+	m.Lock()
+	defer m.Unlock()
+	i := m.find(id)
+	if i < 0 {
+		return messageArgs{}, false
+	}
+	return m.msgs[i], true
+}
+
+func (m *memoryStore) Thread(root int64) []messageArgs {
+	m.Lock()
+	defer m.Unlock()
+
+	var replies []messageArgs
+	for _, id := range m.threads[root] {
+		if i := m.find(id); i >= 0 {
+			replies = append(replies, m.msgs[i])
+		}
+	}
+	return replies
+}
+
+// replace stores msg over the message with the same ID, or appends it if
+// there is none.
+func (m *memoryStore) replace(msg messageArgs) {
+	m.Lock()
+	i := m.find(msg.ID)
+	if i >= 0 {
+		m.msgs[i] = msg
+	}
+	m.Unlock()
+	if i < 0 {
+		m.Append(msg)
+	}
+}
+
+func (m *memoryStore) Close() error {
+	return nil
+}
+
+// fileStore appends every message to a log file of JSON lines and serves
+// reads from an in-memory ring that is primed from the log on startup.
+// Updated messages are appended again in full; when priming, later lines
+// replace earlier ones with the same ID.
+type fileStore struct {
+	*memoryStore
+
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+func openFileStore(path string, capacity int) (*fileStore, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	mem := newMemoryStore(capacity)
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var msg messageArgs
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			log.Printf("skipping corrupt history entry in %s: %s", path, err)
+			continue
+		}
+		mem.replace(msg)
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &fileStore{
+		memoryStore: mem,
+		f:           f,
+		enc:         json.NewEncoder(f),
+	}, nil
+}
+
+func (fs *fileStore) Append(msg messageArgs) error {
+	fs.mu.Lock()
+	err := fs.enc.Encode(msg)
+	fs.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return fs.memoryStore.Append(msg)
+}
+
+func (fs *fileStore) Update(id int64, change func(*messageArgs) error) (messageArgs, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	msg, err := fs.memoryStore.Update(id, change)
+	if err != nil {
+		return msg, err
+	}
+	return msg, fs.enc.Encode(msg)
+}
+
+func (fs *fileStore) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.f.Close()
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2016, RetailNext, Inc.
+// This material contains trade secrets and confidential information of
+// RetailNext, Inc.  Any use, reproduction, disclosure or dissemination
+// is strictly prohibited without the explicit written permission
+// of RetailNext, Inc.
+// All rights reserved.
+
+package main
+
+import (
+	"log"
+	"regexp"
+	"strings"
+)
+
+var mentionPattern = regexp.MustCompile(`@([A-Za-z0-9][A-Za-z0-9_.#-]{0,23})`)
+
+// parseMentions returns the connected users that text mentions as @name,
+// in order and without repeats.
+func (s *server) parseMentions(text string) []string {
+	var mentions []string
+	seen := make(map[string]bool)
+
+	s.RLock()
+	defer s.RUnlock()
+	for _, m := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		name := m[1]
+		if s.clients[name] == nil {
+			// Allow for punctuation after the name.
+			name = strings.TrimRight(name, ".-")
+		}
+		if s.clients[name] != nil && !seen[name] {
+			seen[name] = true
+			mentions = append(mentions, name)
+		}
+	}
+	return mentions
+}
+
+// notifyMentions sends a mention command with msg to each user in names
+// other than the sender. Only the other party hears about mentions in a
+// private message.
+func (s *server) notifyMentions(msg messageArgs, names []string) {
+	var targets []Client
+	s.RLock()
+	for _, name := range names {
+		if name == msg.Sender || (msg.Private && name != msg.Recipient) {
+			continue
+		}
+		if c := s.clients[name]; c != nil {
+			targets = append(targets, c)
+		}
+	}
+	s.RUnlock()
+
+	for _, c := range targets {
+		if err := c.SendCommand("mention", msg); err != nil {
+			log.Printf("Failed sending mention to %s: %s", c.Name(), err)
+		}
+	}
+}
+
+// mentions reports whether msg mentions name.
+func (m messageArgs) mentions(name string) bool {
+	return indexOf(m.Mentions, name) >= 0
+}
@@ -0,0 +1,179 @@
+// Copyright (c) 2016, RetailNext, Inc.
+// This material contains trade secrets and confidential information of
+// RetailNext, Inc.  Any use, reproduction, disclosure or dissemination
+// is strictly prohibited without the explicit written permission
+// of RetailNext, Inc.
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// counterVec is a set of counters distinguished by one label value.
+type counterVec struct {
+	sync.Mutex
+	values map[string]*int64
+}
+
+func newCounterVec() *counterVec {
+	return &counterVec{values: make(map[string]*int64)}
+}
+
+func (cv *counterVec) inc(label string) {
+	cv.Lock()
+	v := cv.values[label]
+	if v == nil {
+		v = new(int64)
+		cv.values[label] = v
+	}
+	cv.Unlock()
+	atomic.AddInt64(v, 1)
+}
+
+func (cv *counterVec) snapshot() map[string]int64 {
+	cv.Lock()
+	defer cv.Unlock()
+	snap := make(map[string]int64, len(cv.values))
+	for label, v := range cv.values {
+		snap[label] = atomic.LoadInt64(v)
+	}
+	return snap
+}
+
+// histogram counts observations in seconds into cumulative buckets.
+type histogram struct {
+	sync.Mutex
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+var latencyBuckets = []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5}
+
+func newHistogram() *histogram {
+	return &histogram{
+		bounds: latencyBuckets,
+		counts: make([]uint64, len(latencyBuckets)),
+	}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	h.Lock()
+	defer h.Unlock()
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name, labels string) {
+	h.Lock()
+	defer h.Unlock()
+
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, sep, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+type serverMetrics struct {
+	messages      *counterVec
+	sendFailures  int64
+	upgradeErrors int64
+	readLockWait  *histogram
+	writeLockWait *histogram
+	fanout        *histogram
+}
+
+var metrics = serverMetrics{
+	messages:      newCounterVec(),
+	readLockWait:  newHistogram(),
+	writeLockWait: newHistogram(),
+	fanout:        newHistogram(),
+}
+
+// Lock and RLock shadow the embedded RWMutex to record how long callers
+// wait for the server lock.
+func (s *server) Lock() {
+	start := time.Now()
+	s.RWMutex.Lock()
+	metrics.writeLockWait.observe(time.Since(start))
+}
+
+func (s *server) RLock() {
+	start := time.Now()
+	s.RWMutex.RLock()
+	metrics.readLockWait.observe(time.Since(start))
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// serveMetrics writes the metrics in the Prometheus text format.
+func (s *server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	users := make(map[string]int)
+	s.RLock()
+	for _, c := range s.clients {
+		if _, ok := c.(*webClient); ok {
+			users["web"]++
+		} else {
+			users["bot"]++
+		}
+	}
+	s.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writeHeader(w, "trekchat_connected_users", "gauge", "Users currently connected, by kind.")
+	for _, kind := range []string{"web", "bot"} {
+		fmt.Fprintf(w, "trekchat_connected_users{kind=%q} %d\n", kind, users[kind])
+	}
+
+	writeHeader(w, "trekchat_messages_total", "counter", "Chat messages sent, by type.")
+	messages := metrics.messages.snapshot()
+	var types []string
+	for t := range messages {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	for _, t := range types {
+		fmt.Fprintf(w, "trekchat_messages_total{type=%q} %d\n", t, messages[t])
+	}
+
+	writeHeader(w, "trekchat_send_failures_total", "counter", "Commands that could not be queued for a websocket.")
+	fmt.Fprintf(w, "trekchat_send_failures_total %d\n", atomic.LoadInt64(&metrics.sendFailures))
+
+	writeHeader(w, "trekchat_websocket_upgrade_errors_total", "counter", "Requests to /connect that failed to become websockets.")
+	fmt.Fprintf(w, "trekchat_websocket_upgrade_errors_total %d\n", atomic.LoadInt64(&metrics.upgradeErrors))
+
+	writeHeader(w, "trekchat_server_lock_wait_seconds", "histogram", "Time spent waiting for the server lock, by mode.")
+	metrics.readLockWait.write(w, "trekchat_server_lock_wait_seconds", `mode="read"`)
+	metrics.writeLockWait.write(w, "trekchat_server_lock_wait_seconds", `mode="write"`)
+
+	writeHeader(w, "trekchat_broadcast_fanout_seconds", "histogram", "Time taken to fan a command out to a room.")
+	metrics.fanout.write(w, "trekchat_broadcast_fanout_seconds", "")
+}
@@ -0,0 +1,391 @@
+// Copyright (c) 2016, RetailNext, Inc.
+// This material contains trade secrets and confidential information of
+// RetailNext, Inc.  Any use, reproduction, disclosure or dissemination
+// is strictly prohibited without the explicit written permission
+// of RetailNext, Inc.
+// All rights reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const auditCapacity = 1000
+
+type ban struct {
+	Name    string    `json:"name"`
+	Addr    string    `json:"addr,omitempty"`
+	By      string    `json:"by"`
+	Reason  string    `json:"reason"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires,omitzero"`
+}
+
+func (b *ban) expired(now time.Time) bool {
+	return !b.Expires.IsZero() && now.After(b.Expires)
+}
+
+// banList holds the active bans, persisted as a JSON file when path is set.
+type banList struct {
+	sync.Mutex
+	path string
+	bans map[string]*ban
+}
+
+func openBanList(path string) (*banList, error) {
+	bl := &banList{
+		path: path,
+		bans: make(map[string]*ban),
+	}
+	if path == "" {
+		return bl, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return bl, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var bans []*ban
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %s", path, err)
+	}
+	for _, b := range bans {
+		bl.bans[b.Name] = b
+	}
+	return bl, nil
+}
+
+func (bl *banList) add(b *ban) error {
+	bl.Lock()
+	defer bl.Unlock()
+	bl.bans[b.Name] = b
+	return bl.save()
+}
+
+func (bl *banList) remove(name string) error {
+	bl.Lock()
+	defer bl.Unlock()
+	if bl.bans[name] == nil {
+		return fmt.Errorf("%s is not banned", name)
+	}
+	delete(bl.bans, name)
+	return bl.save()
+}
+
+// lookup returns the ban on name or on addr, if any.
+func (bl *banList) lookup(name, addr string) *ban {
+	bl.Lock()
+	defer bl.Unlock()
+
+	now := time.Now()
+	for key, b := range bl.bans {
+		if b.expired(now) {
+			delete(bl.bans, key)
+			continue
+		}
+		if (name != "" && b.Name == name) || (addr != "" && b.Addr == addr) {
+			return b
+		}
+	}
+	return nil
+}
+
+func (bl *banList) list() []ban {
+	bl.Lock()
+	defer bl.Unlock()
+
+	now := time.Now()
+	var bans []ban
+	for _, b := range bl.bans {
+		if !b.expired(now) {
+			bans = append(bans, *b)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Name < bans[j].Name
+	})
+	return bans
+}
+
+// save writes the bans to disk. The caller must hold the lock.
+func (bl *banList) save() error {
+	if bl.path == "" {
+		return nil
+	}
+
+	bans := make([]*ban, 0, len(bl.bans))
+	for _, b := range bl.bans {
+		bans = append(bans, b)
+	}
+	data, err := json.MarshalIndent(bans, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := bl.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, bl.path)
+}
+
+type auditEntry struct {
+	Time     time.Time `json:"time"`
+	Actor    string    `json:"actor"`
+	Action   string    `json:"action"`
+	Target   string    `json:"target"`
+	Reason   string    `json:"reason,omitempty"`
+	Duration duration  `json:"duration,omitzero"`
+}
+
+// auditLog remembers recent moderation actions and appends every one to a
+// file of JSON lines when one is configured.
+type auditLog struct {
+	sync.Mutex
+	f       *os.File
+	entries []auditEntry
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	al := &auditLog{}
+	if path == "" {
+		return al, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	al.f = f
+	return al, nil
+}
+
+func (al *auditLog) record(e auditEntry) {
+	al.Lock()
+	defer al.Unlock()
+
+	al.entries = append(al.entries, e)
+	if len(al.entries) > auditCapacity {
+		al.entries = al.entries[len(al.entries)-auditCapacity:]
+	}
+
+	if al.f != nil {
+		if err := json.NewEncoder(al.f).Encode(e); err != nil {
+			log.Printf("Failed writing audit log: %s", err)
+		}
+	}
+}
+
+func (al *auditLog) recent() []auditEntry {
+	al.Lock()
+	defer al.Unlock()
+	return append([]auditEntry(nil), al.entries...)
+}
+
+func (al *auditLog) Close() error {
+	if al.f == nil {
+		return nil
+	}
+	return al.f.Close()
+}
+
+type moderationArgs struct {
+	Name     string   `json:"name" schema:"required"`
+	Reason   string   `json:"reason"`
+	Duration duration `json:"duration"`
+}
+
+// moderatedArgs confirms a moderation command to the admin who gave it.
+type moderatedArgs struct {
+	Action string `json:"action"`
+	Name   string `json:"name"`
+}
+
+// moderationNotice tells a user what an admin did to them, and until when
+// if it does not last for good.
+type moderationNotice struct {
+	Action string    `json:"action"`
+	By     string    `json:"by"`
+	Reason string    `json:"reason"`
+	Until  time.Time `json:"until,omitzero"`
+}
+
+func (a moderationArgs) validate() error {
+	if a.Name == "" {
+		return errors.New("no user given")
+	}
+	if a.Duration.Duration < 0 {
+		return errors.New("duration is negative")
+	}
+	return nil
+}
+
+var errNotAdmin = errors.New("only admins can do that")
+
+func (s *server) isAdmin(c Client) bool {
+	wc, ok := c.(*webClient)
+	if !ok || !wc.authenticated {
+		return false
+	}
+	for _, admin := range s.config.Admins {
+		if admin == wc.Name() {
+			return true
+		}
+	}
+	return false
+}
+
+// moderate applies a kick, mute, ban or unban of target on behalf of actor
+// and records it in the audit log. A zero duration mutes for the configured
+// mute duration and bans forever.
+func (s *server) moderate(actor, action string, args moderationArgs) error {
+	target := args.Name
+	if target == "" {
+		return errors.New("no user given")
+	}
+	if target == actor {
+		return fmt.Errorf("you cannot %s yourself", action)
+	}
+
+	s.RLock()
+	c := s.clients[target]
+	s.RUnlock()
+
+	now := time.Now()
+	d := args.Duration.Duration
+
+	notify := func(until time.Time) {
+		if c == nil {
+			return
+		}
+		c.SendCommand("moderation", moderationNotice{
+			Action: action,
+			By:     actor,
+			Reason: args.Reason,
+			Until:  until.UTC(),
+		})
+	}
+
+	switch action {
+	case "kick":
+		if c == nil {
+			return fmt.Errorf("%s is not connected", target)
+		}
+		notify(time.Time{})
+		s.disconnect(c, websocket.ClosePolicyViolation, "kicked by "+actor)
+	case "mute":
+		if d == 0 {
+			d = s.limiter.muteDuration
+		}
+		until := now.Add(d)
+		switch {
+		case c != nil:
+			s.limiter.mute(c, until)
+		case s.users.exists(target):
+			s.limiter.muteAccount(target, until)
+		default:
+			return fmt.Errorf("%s is not connected", target)
+		}
+		s.Lock()
+		if stats := s.clientStats[target]; stats != nil {
+			stats.MuteCount++
+			stats.MutedUntil = until.UTC()
+		}
+		s.Unlock()
+		notify(until)
+	case "ban":
+		b := &ban{
+			Name:    target,
+			By:      actor,
+			Reason:  args.Reason,
+			Created: now.UTC(),
+		}
+		if d > 0 {
+			b.Expires = now.Add(d).UTC()
+		}
+		if wc, ok := c.(*webClient); ok && !wc.authenticated {
+			b.Addr = wc.addr
+		}
+		if err := s.bans.add(b); err != nil {
+			return err
+		}
+		if c != nil {
+			notify(b.Expires)
+			s.disconnect(c, websocket.ClosePolicyViolation, "banned by "+actor)
+		}
+	case "unban":
+		if err := s.bans.remove(target); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown moderation action %q", action)
+	}
+
+	log.Printf("%s: %s %s %s", actor, action, target, args.Reason)
+	s.audit.record(auditEntry{
+		Time:     now.UTC(),
+		Actor:    actor,
+		Action:   action,
+		Target:   target,
+		Reason:   args.Reason,
+		Duration: duration{d},
+	})
+	return nil
+}
+
+// debugModerate handles POST /debug/chat/moderate/<action>/<name> with
+// optional reason and duration form values.
+func (s *server) debugModerate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/debug/chat/moderate/"), "/")
+	if len(parts) != 2 {
+		http.Error(w, "expected /debug/chat/moderate/<action>/<name>", http.StatusNotFound)
+		return
+	}
+
+	args := moderationArgs{
+		Name:   parts[1],
+		Reason: r.FormValue("reason"),
+	}
+	if d := r.FormValue("duration"); d != "" {
+		if err := args.Duration.UnmarshalText([]byte(d)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := s.moderate("debug:"+r.RemoteAddr, parts[0], args); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintf(w, "%s %q\n", parts[0], args.Name)
+}
+
+func (s *server) debugBans(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.bans.list())
+}
+
+func (s *server) debugAudit(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.audit.recent())
+}
@@ -0,0 +1,224 @@
+// Copyright (c) 2016, RetailNext, Inc.
+// This material contains trade secrets and confidential information of
+// RetailNext, Inc.  Any use, reproduction, disclosure or dissemination
+// is strictly prohibited without the explicit written permission
+// of RetailNext, Inc.
+// All rights reserved.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// idleAfter is how long an online user can go without sending a
+	// command before they are shown as idle.
+	idleAfter = 5 * time.Minute
+	// presenceCheckInterval is how often users are checked for going idle
+	// or coming back.
+	presenceCheckInterval = 30 * time.Second
+
+	// Repeated typing notices for the same conversation are only passed
+	// on every typingDebounce, and peers drop a notice after typingExpiry
+	// unless it is refreshed.
+	typingDebounce = 2 * time.Second
+	typingExpiry   = 6 * time.Second
+)
+
+// presenceStates are the states users can pick. Online users who stop
+// sending commands are reported as idle.
+var presenceStates = map[string]bool{
+	"online": true,
+	"away":   true,
+	"busy":   true,
+}
+
+type presenceArgs struct {
+	Presence string `json:"presence" schema:"required"`
+}
+
+func (a presenceArgs) validate() error {
+	if !presenceStates[a.Presence] {
+		return fmt.Errorf("unknown presence %q", a.Presence)
+	}
+	return nil
+}
+
+// userInfo describes a member of a room in the users command.
+type userInfo struct {
+	Name       string    `json:"name"`
+	Presence   string    `json:"presence"`
+	LastActive time.Time `json:"last_active,omitzero"`
+	Bot        bool      `json:"bot,omitempty"`
+}
+
+type typingArgs struct {
+	Room      string `json:"room,omitempty"`
+	Recipient string `json:"recipient,omitempty"`
+	Typing    bool   `json:"typing"`
+}
+
+func (a typingArgs) validate() error {
+	if (a.Room == "") == (a.Recipient == "") {
+		return errors.New("typing takes either a room or a recipient")
+	}
+	return nil
+}
+
+type typingNotice struct {
+	Name    string    `json:"name"`
+	Room    string    `json:"room,omitempty"`
+	Private bool      `json:"private"`
+	Typing  bool      `json:"typing"`
+	Expires time.Time `json:"expires,omitzero"`
+}
+
+// info reports c's presence, showing online users as idle once they have
+// been quiet for idleAfter.
+func (c *webClient) info() userInfo {
+	c.RLock()
+	presence := c.presence
+	c.RUnlock()
+
+	lastActive := time.Unix(0, atomic.LoadInt64(&c.lastActive))
+	if presence == "online" && time.Since(lastActive) >= idleAfter {
+		presence = "idle"
+	}
+	return userInfo{
+		Name:       c.Name(),
+		Presence:   presence,
+		LastActive: lastActive.UTC(),
+	}
+}
+
+func userInfoOf(c Client) userInfo {
+	if wc, ok := c.(*webClient); ok {
+		return wc.info()
+	}
+	return userInfo{
+		Name:     c.Name(),
+		Presence: "online",
+		Bot:      true,
+	}
+}
+
+func (s *server) setPresence(c *webClient, presence string) error {
+	c.Lock()
+	c.presence = presence
+	c.Unlock()
+
+	for _, room := range s.roomsOf(c.Name()) {
+		s.broadcastUsers(room)
+	}
+	return nil
+}
+
+// setTyping tells the room or private recipient in args that c has started
+// or stopped typing. Repeats within typingDebounce are dropped, as are stops
+// for conversations c was not typing in.
+func (s *server) setTyping(c *webClient, args typingArgs) error {
+	key := "@" + args.Recipient
+	if args.Room != "" {
+		if !s.inRoom(c.Name(), args.Room) {
+			return fmt.Errorf("not in room %s", args.Room)
+		}
+		key = "#" + args.Room
+	}
+
+	now := time.Now()
+	c.Lock()
+	last := c.typing[key]
+	if args.Typing {
+		if now.Sub(last) < typingDebounce {
+			c.Unlock()
+			return nil
+		}
+		c.typing[key] = now
+	} else {
+		delete(c.typing, key)
+	}
+	c.Unlock()
+
+	if !args.Typing && now.Sub(last) > typingExpiry {
+		return nil
+	}
+
+	notice := typingNotice{
+		Name:   c.Name(),
+		Room:   args.Room,
+		Typing: args.Typing,
+	}
+	if args.Typing {
+		notice.Expires = now.Add(typingExpiry).UTC()
+	}
+
+	if args.Room != "" {
+		s.broadcastCommand(args.Room, c, "typing", notice)
+		return nil
+	}
+
+	s.RLock()
+	recipient := s.clients[args.Recipient]
+	s.RUnlock()
+	if recipient == nil {
+		return fmt.Errorf("no such recipient %s", args.Recipient)
+	}
+	notice.Private = true
+	return recipient.SendCommand("typing", notice)
+}
+
+// stopTyping clears any typing notice c has out for the conversation msg is
+// sent to.
+func (s *server) stopTyping(c *webClient, msg *messageArgs) {
+	args := typingArgs{Room: msg.Room}
+	if msg.Private {
+		args = typingArgs{Recipient: msg.Recipient}
+	}
+	s.setTyping(c, args)
+}
+
+// watchPresence resends the users of any room whose members have gone idle
+// or come back since the last check.
+func (s *server) watchPresence() {
+	ticker := time.NewTicker(presenceCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+
+		var changed []string
+		s.RLock()
+		for _, c := range s.clients {
+			wc, ok := c.(*webClient)
+			if !ok {
+				continue
+			}
+			idle := wc.info().Presence == "idle"
+			wc.Lock()
+			if idle != wc.shownIdle {
+				wc.shownIdle = idle
+				changed = append(changed, wc.name)
+			}
+			wc.Unlock()
+		}
+		s.RUnlock()
+
+		rooms := make(map[string]bool)
+		for _, name := range changed {
+			for _, room := range s.roomsOf(name) {
+				rooms[room] = true
+			}
+		}
+		for room := range rooms {
+			s.broadcastUsers(room)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright (c) 2016, RetailNext, Inc.
+// This material contains trade secrets and confidential information of
+// RetailNext, Inc.  Any use, reproduction, disclosure or dissemination
+// is strictly prohibited without the explicit written permission
+// of RetailNext, Inc.
+// All rights reserved.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// protocolVersion is the newest protocol the server speaks. Clients
+	// that connect without saying hello speak version 1, the protocol as
+	// it was before the handshake.
+	protocolVersion = 2
+
+	// helloTimeout is how long a new connection has to say hello before
+	// it is taken to speak version 1.
+	helloTimeout = time.Second
+)
+
+// capabilities are the optional features a client can ask for in its
+// hello. Each gates the commands the server sends for it; version 1
+// clients get none of them.
+var capabilities = map[string][]string{
+	"acks":           {"ack"},
+	"edits":          {"message_edited", "message_deleted"},
+	"mentions":       {"mention"},
+	"presence":       nil,
+	"reactions":      {"reaction_update"},
+	"slash_commands": {"command_output", "switched_room"},
+	"threads":        {"thread"},
+	"typing":         {"typing"},
+}
+
+// commandCapabilities maps each gated command to its capability.
+var commandCapabilities = make(map[string]string)
+
+func init() {
+	for capability, commands := range capabilities {
+		for _, command := range commands {
+			commandCapabilities[command] = capability
+		}
+	}
+}
+
+type helloArgs struct {
+	Version  int      `json:"version" schema:"required"`
+	Features []string `json:"features"`
+}
+
+func (a helloArgs) validate() error {
+	if a.Version < 1 {
+		return fmt.Errorf("unsupported protocol version %d", a.Version)
+	}
+	return nil
+}
+
+type welcomeArgs struct {
+	Name          string `json:"name"`
+	Authenticated bool   `json:"authenticated"`
+	// Version and Capabilities are only sent in answer to a hello.
+	Version      int      `json:"version,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	// ResumeToken lets a version 2 client take its name back after its
+	// connection drops; see resume.
+	ResumeToken string `json:"resume_token,omitempty"`
+	// Resumed is set when answering a resume, with how many commands are
+	// being replayed and how many were lost.
+	Resumed bool `json:"resumed,omitempty"`
+	Missed  int  `json:"missed,omitempty"`
+	Dropped int  `json:"dropped,omitempty"`
+}
+
+// usersArgs lists the members of a room. Clients without the presence
+// capability get just their names.
+type usersArgs struct {
+	Room  string     `json:"room"`
+	Users []userInfo `json:"users"`
+}
+
+func (s *server) cmdHello(c *connection, args *helloArgs) (string, interface{}, error) {
+	if !s.welcome(c, args) {
+		return "", nil, errors.New("hello must be the first command")
+	}
+	return "", nil, nil
+}
+
+// welcome settles which protocol c speaks, from its hello or as version 1
+// if hello is nil, then greets c. It reports whether it did so; only the
+// first call for a connection does anything.
+func (s *server) welcome(c *connection, hello *helloArgs) bool {
+	welcomed := false
+	c.welcomeOnce.Do(func() {
+		welcomed = true
+		s.greet(c, hello)
+	})
+	return welcomed
+}
+
+// greet welcomes c and starts sending it its client's commands. The first
+// connection of a client, which is in no room yet, puts it in the default
+// room; later ones are told about the rooms it is already in.
+func (s *server) greet(c *connection, hello *helloArgs) {
+	args := welcomeArgs{
+		Name:          c.Name(),
+		Authenticated: c.client.authenticated,
+	}
+	version := 1
+	enabled := make(map[string]bool)
+	if hello != nil {
+		version = hello.Version
+		if version > protocolVersion {
+			version = protocolVersion
+		}
+		for _, feature := range hello.Features {
+			if _, ok := capabilities[feature]; ok && version > 1 {
+				enabled[feature] = true
+				args.Capabilities = append(args.Capabilities, feature)
+			}
+		}
+		sort.Strings(args.Capabilities)
+		args.Version = version
+	}
+
+	c.Lock()
+	c.version = version
+	c.capabilities = enabled
+	c.Unlock()
+
+	var err error
+	if version > 1 {
+		args.ResumeToken, err = s.issueResumeToken(c)
+	}
+	if err == nil {
+		err = c.SendCommand("welcome", args)
+	}
+
+	// A client in some room is not new even if none of its other
+	// connections is left, as one may have closed since c was attached.
+	wc := c.client
+	first := len(s.roomsOf(wc.Name())) == 0
+	wc.Lock()
+	for _, welcomed := range wc.conns {
+		first = first && !welcomed
+	}
+	wc.conns[c] = true
+	wc.Unlock()
+
+	if err == nil && first {
+		err = s.joinRoom(wc, defaultRoom)
+		if err == nil {
+			err = s.sendHistory(c, defaultRoom, true)
+		}
+	} else if err == nil {
+		err = s.sendRooms(c)
+	}
+	if err != nil {
+		log.Printf("Error welcoming %s: %s", c.Name(), err)
+		c.close(websocket.CloseInternalServerErr, "")
+	}
+}
+
+// adapt rewrites command for the protocol c speaks, reporting false if c
+// should not get it at all.
+func (c *connection) adapt(command string, args interface{}) (interface{}, bool) {
+	c.RLock()
+	defer c.RUnlock()
+
+	if capability, ok := commandCapabilities[command]; ok && !c.capabilities[capability] {
+		return nil, false
+	}
+	if users, ok := args.(usersArgs); ok && !c.capabilities["presence"] {
+		names := make([]string, len(users.Users))
+		for i, u := range users.Users {
+			names[i] = u.Name
+		}
+		return map[string]interface{}{
+			"room":  users.Room,
+			"users": names,
+		}, true
+	}
+	return args, true
+}
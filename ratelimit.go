@@ -0,0 +1,213 @@
+// Copyright (c) 2016, RetailNext, Inc.
+// This material contains trade secrets and confidential information of
+// RetailNext, Inc.  Any use, reproduction, disclosure or dissemination
+// is strictly prohibited without the explicit written permission
+// of RetailNext, Inc.
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// tokenBucket allows bursts of up to burst events, refilled at rate per
+// second.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+type rateLimit struct {
+	rate  float64
+	burst int
+}
+
+type verdict int
+
+const (
+	allowed verdict = iota
+	limited
+	muted
+	disconnected
+)
+
+type clientLimits struct {
+	buckets    map[string]*tokenBucket
+	strikes    int
+	mutes      int
+	mutedUntil time.Time
+	// adminMutedUntil is kept apart from mutedUntil so that flooding
+	// cannot shorten a mute imposed by an admin.
+	adminMutedUntil time.Time
+}
+
+// rateLimiter enforces per client, per message type limits. Every message
+// that is refused is a strike; enough strikes mute the client, and being
+// muted too many times gets it disconnected.
+type rateLimiter struct {
+	sync.Mutex
+	limits            map[string]rateLimit
+	strikesToMute     int
+	muteDuration      time.Duration
+	mutesToDisconnect int
+	clients           map[Client]*clientLimits
+	// held keeps, by muteIdentity, when the admin mutes of clients that
+	// left end.
+	held map[string]time.Time
+}
+
+// muteIdentity is what an admin mute of c is kept under once c leaves:
+// the account of a registered user, or else the address of a guest, much
+// as bans go. A guest cannot shake off a mute by reconnecting, and another
+// taking its name does not inherit it.
+func muteIdentity(c Client) string {
+	if wc, ok := c.(*webClient); ok && !wc.authenticated {
+		return "addr:" + wc.addr
+	}
+	return "name:" + c.Name()
+}
+
+func newRateLimiter(cfg *config) *rateLimiter {
+	return &rateLimiter{
+		limits: map[string]rateLimit{
+			"broadcast": {cfg.BroadcastRate, cfg.BroadcastBurst},
+			"private":   {cfg.PrivateRate, cfg.PrivateBurst},
+		},
+		strikesToMute:     cfg.StrikesToMute,
+		muteDuration:      cfg.MuteDuration.Duration,
+		mutesToDisconnect: cfg.MutesToDisconnect,
+		clients:           make(map[Client]*clientLimits),
+		held:              make(map[string]time.Time),
+	}
+}
+
+// limitsOf returns the limits of c, whose muteIdentity is id, taking over
+// any admin mute held for id. The caller must hold the lock.
+func (rl *rateLimiter) limitsOf(c Client, id string, now time.Time) *clientLimits {
+	cl := rl.clients[c]
+	if cl == nil {
+		cl = &clientLimits{buckets: make(map[string]*tokenBucket)}
+		if until, ok := rl.held[id]; ok {
+			if now.Before(until) {
+				cl.adminMutedUntil = until
+			}
+			delete(rl.held, id)
+		}
+		rl.clients[c] = cl
+	}
+	return cl
+}
+
+// check records an attempt by c to send a message of kind. The error
+// explains any verdict other than allowed.
+func (rl *rateLimiter) check(c Client, kind string, now time.Time) (verdict, error) {
+	id := muteIdentity(c)
+	rl.Lock()
+	defer rl.Unlock()
+
+	cl := rl.limitsOf(c, id, now)
+
+	// Messages sent while muted by an admin are not strikes; the admin
+	// has already decided how long the mute lasts.
+	if now.Before(cl.adminMutedUntil) {
+		return limited, fmt.Errorf("you are muted for another %s", cl.adminMutedUntil.Sub(now).Round(time.Second))
+	}
+
+	var err error
+	if now.Before(cl.mutedUntil) {
+		err = fmt.Errorf("you are muted for another %s", cl.mutedUntil.Sub(now).Round(time.Second))
+	} else {
+		b := cl.buckets[kind]
+		if b == nil {
+			limit := rl.limits[kind]
+			b = &tokenBucket{
+				rate:   limit.rate,
+				burst:  float64(limit.burst),
+				tokens: float64(limit.burst),
+				last:   now,
+			}
+			cl.buckets[kind] = b
+		}
+		if b.allow(now) {
+			return allowed, nil
+		}
+		err = fmt.Errorf("rate limit exceeded for %s messages", kind)
+	}
+
+	cl.strikes++
+	if cl.strikes < rl.strikesToMute {
+		return limited, err
+	}
+
+	cl.strikes = 0
+	cl.mutes++
+	if cl.mutes > rl.mutesToDisconnect {
+		delete(rl.clients, c)
+		return disconnected, fmt.Errorf("disconnected for flooding")
+	}
+	cl.mutedUntil = now.Add(rl.muteDuration)
+	return muted, fmt.Errorf("muted for %s for flooding", rl.muteDuration)
+}
+
+// adminMuted returns an error if an admin has muted c.
+func (rl *rateLimiter) adminMuted(c Client, now time.Time) error {
+	id := muteIdentity(c)
+	rl.Lock()
+	defer rl.Unlock()
+	if cl := rl.limitsOf(c, id, now); now.Before(cl.adminMutedUntil) {
+		return fmt.Errorf("you are muted for another %s", cl.adminMutedUntil.Sub(now).Round(time.Second))
+	}
+	return nil
+}
+
+// mute silences c until the given time, regardless of its rate and of any
+// mute for flooding.
+func (rl *rateLimiter) mute(c Client, until time.Time) {
+	id := muteIdentity(c)
+	rl.Lock()
+	defer rl.Unlock()
+	rl.limitsOf(c, id, time.Now()).adminMutedUntil = until
+}
+
+// muteAccount silences the registered user name, who is not connected,
+// until the given time.
+func (rl *rateLimiter) muteAccount(name string, until time.Time) {
+	rl.Lock()
+	defer rl.Unlock()
+	rl.held["name:"+name] = until
+}
+
+// forget drops the limits of c, which left, keeping any admin mute still
+// running for whoever next connects as the same identity.
+func (rl *rateLimiter) forget(c Client, now time.Time) {
+	id := muteIdentity(c)
+	rl.Lock()
+	defer rl.Unlock()
+
+	for held, until := range rl.held {
+		if !now.Before(until) {
+			delete(rl.held, held)
+		}
+	}
+	cl := rl.clients[c]
+	delete(rl.clients, c)
+	if cl != nil && now.Before(cl.adminMutedUntil) && cl.adminMutedUntil.After(rl.held[id]) {
+		rl.held[id] = cl.adminMutedUntil
+	}
+}
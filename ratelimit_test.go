@@ -0,0 +1,64 @@
+// Copyright (c) 2016, RetailNext, Inc.
+// This material contains trade secrets and confidential information of
+// RetailNext, Inc.  Any use, reproduction, disclosure or dissemination
+// is strictly prohibited without the explicit written permission
+// of RetailNext, Inc.
+// All rights reserved.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterForget(t *testing.T) {
+	rl := newRateLimiter(defaultConfig())
+	now := time.Now()
+
+	sulu := &webClient{name: "sulu", addr: "10.0.0.1"}
+	if v, err := rl.check(sulu, "broadcast", now); v != allowed {
+		t.Fatalf("first message refused: %v", err)
+	}
+	rl.forget(sulu, now)
+	if len(rl.clients) != 0 || len(rl.held) != 0 {
+		t.Fatalf("limits of a client that left kept: %v, %v", rl.clients, rl.held)
+	}
+}
+
+func TestAdminMuteOutlivesClient(t *testing.T) {
+	rl := newRateLimiter(defaultConfig())
+	now := time.Now()
+	until := now.Add(time.Hour)
+
+	guest := &webClient{name: "sulu", addr: "10.0.0.1"}
+	rl.mute(guest, until)
+	rl.forget(guest, now)
+	if len(rl.clients) != 0 {
+		t.Fatalf("limits of a client that left kept: %v", rl.clients)
+	}
+
+	// Another guest taking the name is not muted; the same one coming
+	// back under another name is.
+	if err := rl.adminMuted(&webClient{name: "sulu", addr: "10.0.0.2"}, now); err != nil {
+		t.Errorf("new guest with the name of a muted one: %v", err)
+	}
+	if err := rl.adminMuted(&webClient{name: "wesley", addr: "10.0.0.1"}, now); err == nil {
+		t.Error("muted guest escaped the mute by reconnecting")
+	}
+
+	user := &webClient{name: "picard", addr: "10.0.0.3", authenticated: true}
+	rl.mute(user, until)
+	rl.forget(user, now)
+	if err := rl.adminMuted(&webClient{name: "picard", addr: "10.0.0.4", authenticated: true}, now); err == nil {
+		t.Error("muted user escaped the mute by reconnecting")
+	}
+
+	// Mutes that ran out are dropped.
+	rl.mute(guest, now.Add(time.Minute))
+	rl.forget(guest, now)
+	rl.forget(user, now.Add(2*time.Minute))
+	if len(rl.held) != 0 {
+		t.Errorf("expired mutes kept: %v", rl.held)
+	}
+}
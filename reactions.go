@@ -0,0 +1,110 @@
+// Copyright (c) 2016, RetailNext, Inc.
+// This material contains trade secrets and confidential information of
+// RetailNext, Inc.  Any use, reproduction, disclosure or dissemination
+// is strictly prohibited without the explicit written permission
+// of RetailNext, Inc.
+// All rights reserved.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxEmojiLength         = 8
+	maxReactionsPerMessage = 20
+)
+
+type reactionArgs struct {
+	ID    int64  `json:"id" schema:"required"`
+	Emoji string `json:"emoji" schema:"required"`
+}
+
+func (a reactionArgs) validate() error {
+	if a.ID == 0 {
+		return errors.New("no message id given")
+	}
+	if a.Emoji == "" || utf8.RuneCountInString(a.Emoji) > maxEmojiLength || strings.IndexFunc(a.Emoji, unicode.IsSpace) >= 0 {
+		return fmt.Errorf("invalid reaction %q", a.Emoji)
+	}
+	return nil
+}
+
+type reactionUpdate struct {
+	ID      int64  `json:"id"`
+	Room    string `json:"room,omitempty"`
+	Private bool   `json:"private"`
+	// Reactions maps each emoji to the users who reacted with it.
+	Reactions map[string][]string `json:"reactions"`
+}
+
+// react adds or removes c's reaction to a message and sends the new totals
+// to everyone who can see the message.
+func (s *server) react(c Client, args reactionArgs, add bool) error {
+	if msg, ok := s.history.Get(args.ID); !ok || !s.canSee(c, msg) {
+		return fmt.Errorf("message %d not found", args.ID)
+	}
+
+	name := c.Name()
+	msg, err := s.history.Update(args.ID, func(msg *messageArgs) error {
+		if msg.Deleted {
+			return fmt.Errorf("message %d was deleted", msg.ID)
+		}
+
+		// The map may be shared with copies handed out by the store, so
+		// it is replaced rather than changed.
+		reactions := make(map[string][]string, len(msg.Reactions)+1)
+		for emoji, users := range msg.Reactions {
+			reactions[emoji] = users
+		}
+
+		users := reactions[args.Emoji]
+		i := indexOf(users, name)
+		if add {
+			if i >= 0 {
+				return fmt.Errorf("you already reacted with %s", args.Emoji)
+			}
+			if users == nil && len(reactions) >= maxReactionsPerMessage {
+				return errors.New("too many different reactions on this message")
+			}
+			reactions[args.Emoji] = append(users[:len(users):len(users)], name)
+		} else {
+			if i < 0 {
+				return fmt.Errorf("you have not reacted with %s", args.Emoji)
+			}
+			if len(users) == 1 {
+				delete(reactions, args.Emoji)
+			} else {
+				reactions[args.Emoji] = append(users[:i:i], users[i+1:]...)
+			}
+		}
+
+		msg.Reactions = reactions
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.notifyAudience(msg, "reaction_update", reactionUpdate{
+		ID:        msg.ID,
+		Room:      msg.Room,
+		Private:   msg.Private,
+		Reactions: msg.Reactions,
+	})
+	return nil
+}
+
+func indexOf(names []string, name string) int {
+	for i, n := range names {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,339 @@
+// Copyright (c) 2016, RetailNext, Inc.
+// This material contains trade secrets and confidential information of
+// RetailNext, Inc.  Any use, reproduction, disclosure or dissemination
+// is strictly prohibited without the explicit written permission
+// of RetailNext, Inc.
+// All rights reserved.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// resumeGrace is how long a dropped connection stays with its client, so the
+// client keeps its name and rooms, buffering what is sent to it, waiting for
+// a new connection to resume it. Zero turns resuming off. Installed from
+// the config at startup.
+var resumeGrace time.Duration
+
+// replayWait is how long a resumed connection waits for room in its queue
+// before replaying more of what it missed.
+const replayWait = 10 * time.Millisecond
+
+// resumeArgs are the args of the resume command. The hello fields are used
+// to welcome the connection afresh if it cannot resume.
+type resumeArgs struct {
+	Token    string   `json:"token" schema:"required"`
+	Version  int      `json:"version" schema:"required"`
+	Features []string `json:"features"`
+}
+
+func (a resumeArgs) validate() error {
+	if a.Token == "" {
+		return errors.New("no resume token given")
+	}
+	return a.hello().validate()
+}
+
+func (a resumeArgs) hello() *helloArgs {
+	return &helloArgs{Version: a.Version, Features: a.Features}
+}
+
+func (s *server) cmdResume(c *connection, args *resumeArgs) (string, interface{}, error) {
+	var err error
+	first := false
+	c.welcomeOnce.Do(func() {
+		first = true
+		if err = s.resume(c, args.Token); err != nil {
+			s.greet(c, args.hello())
+		}
+	})
+	if !first {
+		return "", nil, errors.New("resume must be the first command")
+	}
+	return "", nil, err
+}
+
+// issueResumeToken gives c a new resume token, revoking any it had.
+func (s *server) issueResumeToken(c *connection) (string, error) {
+	if resumeGrace == 0 {
+		return "", nil
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+
+	s.Lock()
+	s.revokeResumeToken(c)
+	c.resumeToken = token
+	s.resumable[token] = c
+	s.Unlock()
+	return token, nil
+}
+
+// resumesName reports whether r carries, as its resume parameter, the token
+// of a held connection of the client called name. A guest that picked its
+// name reconnects asking for it again, and is let in to resume it.
+func (s *server) resumesName(r *http.Request, name string) bool {
+	token := r.URL.Query().Get("resume")
+	if token == "" {
+		return false
+	}
+	s.RLock()
+	defer s.RUnlock()
+	c := s.resumable[token]
+	return c != nil && c.Name() == name
+}
+
+// dropped reports whether c went away without the client or the server
+// closing it on purpose, given the error that ended the read loop.
+func (c *connection) dropped(err error) bool {
+	// Any close frame from the client is on purpose, even one without a
+	// status, which browsers send for a plain ws.close(). A connection
+	// lost without one is reported as an abnormal closure, which no peer
+	// can send.
+	if ce, ok := err.(*websocket.CloseError); ok && ce.Code != websocket.CloseAbnormalClosure {
+		return false
+	}
+	c.RLock()
+	defer c.RUnlock()
+	// close has been called by now, so closeCode is settled.
+	return c.closeCode == websocket.CloseNormalClosure || c.closeCode == websocket.CloseAbnormalClosure
+}
+
+// awaitResume holds c, which dropped, for resumeGrace. It reports whether
+// another connection resumed c in that time; if not, c's token is revoked
+// and c should be removed as usual.
+func (s *server) awaitResume(c *connection) bool {
+	s.RLock()
+	token := c.resumeToken
+	s.RUnlock()
+	if token == "" || s.isShuttingDown() {
+		return false
+	}
+
+	// Only once the writer has put back what it did not send is everything
+	// c missed in one place.
+	<-c.stopped
+	// The token may have been revoked by release meanwhile.
+	resumed := make(chan struct{})
+	release := make(chan struct{})
+	s.Lock()
+	if c.resumeToken == "" {
+		s.Unlock()
+		return false
+	}
+	c.Lock()
+	c.resumed = resumed
+	c.release = release
+	c.Unlock()
+	s.Unlock()
+
+	log.Printf("User %s dropped, holding for %s", c.Name(), resumeGrace)
+	timer := time.NewTimer(resumeGrace)
+	defer timer.Stop()
+	select {
+	case <-resumed:
+		return true
+	case <-timer.C:
+	case <-release:
+	case <-s.stop:
+	}
+
+	// A resume is done under the server lock, so once the token is gone
+	// none can be under way.
+	s.Lock()
+	defer s.Unlock()
+	select {
+	case <-resumed:
+		return true
+	default:
+	}
+	s.revokeResumeToken(c)
+	return false
+}
+
+// release stops wc being resumed, so that a user who is kicked or banned
+// cannot come back through a connection that dropped before. Connections
+// already waiting for a resume stop and are removed as usual.
+func (s *server) release(wc *webClient) {
+	wc.RLock()
+	conns := make([]*connection, 0, len(wc.conns))
+	for conn := range wc.conns {
+		conns = append(conns, conn)
+	}
+	wc.RUnlock()
+
+	s.Lock()
+	defer s.Unlock()
+	for _, conn := range conns {
+		s.revokeResumeToken(conn)
+		conn.Lock()
+		if conn.release != nil {
+			close(conn.release)
+			conn.release = nil
+		}
+		conn.Unlock()
+	}
+}
+
+// revokeResumeToken stops c being resumed. The caller must hold the server
+// lock.
+func (s *server) revokeResumeToken(c *connection) {
+	delete(s.resumable, c.resumeToken)
+	c.resumeToken = ""
+}
+
+// resume makes c, a new connection, take the place of the dropped one
+// holding token in its client. c is welcomed back as that client and sent
+// the commands the dropped connection missed, before any sent since.
+func (s *server) resume(c *connection, token string) error {
+	newToken, err := s.issueResumeToken(c)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	old := s.resumable[token]
+	if old == nil {
+		s.Unlock()
+		return errors.New("unknown or expired resume token")
+	}
+	// The client's lock comes after the connection's, so its name is read
+	// first.
+	wc := old.owner()
+	name := wc.Name()
+	old.Lock()
+	if old.resumed == nil {
+		old.Unlock()
+		s.Unlock()
+		return fmt.Errorf("%s is still connected", name)
+	}
+	if b := s.bans.lookup(name, c.addr); b != nil {
+		old.Unlock()
+		s.Unlock()
+		return errors.New("banned: " + b.Reason)
+	}
+	delete(s.resumable, token)
+	close(old.resumed)
+	old.forward = c
+	missed, dropped := old.missed, old.missedDropped
+	old.missed = nil
+	version, enabled := old.version, old.capabilities
+	old.Unlock()
+
+	// c leaves the client it was attached to. If c was its only connection,
+	// the client was made for c and, as c was never welcomed, is in no room
+	// yet, so it goes too; otherwise it carries on with its other ones.
+	prev := c.client
+	prev.Lock()
+	delete(prev.conns, c)
+	alone := len(prev.conns) == 0
+	guest := prev.name
+	prev.Unlock()
+	if alone && s.clients[guest] == prev {
+		delete(s.clients, guest)
+		if stats := s.clientStats[guest]; stats != nil {
+			if stats.ConnectionCount--; *stats == (clientStats{}) {
+				delete(s.clientStats, guest)
+			}
+		}
+	}
+
+	var features []string
+	for capability := range enabled {
+		features = append(features, capability)
+	}
+	sort.Strings(features)
+	welcome, err := json.Marshal(commandToClient{
+		Command: "welcome",
+		Args: welcomeArgs{
+			Name:          name,
+			Authenticated: wc.authenticated,
+			Version:       version,
+			Capabilities:  features,
+			ResumeToken:   newToken,
+			Resumed:       true,
+			Missed:        len(missed),
+			Dropped:       dropped,
+		},
+	})
+	if err != nil {
+		s.Unlock()
+		return err
+	}
+
+	// Until it has caught up, c keeps what it is sent behind the welcome
+	// and the missed commands, just as a closed connection would.
+	c.Lock()
+	c.client = wc
+	c.version = version
+	c.capabilities = enabled
+	c.detached = true
+	c.missed = missed
+	c.missedDropped = dropped
+	select {
+	case c.send <- welcome:
+	default:
+		c.missed = append([][]byte{welcome}, c.missed...)
+	}
+	c.Unlock()
+	wc.Lock()
+	delete(wc.conns, old)
+	wc.conns[c] = true
+	wc.Unlock()
+	s.Unlock()
+
+	log.Printf("User %s resumed, replaying %d commands", name, len(missed))
+	s.events.publish(event{Type: "resume", User: name, Detail: c.addr})
+	c.replay()
+	return nil
+}
+
+// replay queues the commands c has kept, in order, then lets later ones
+// through. It waits for room in the queue rather than drop any; if c closes
+// meanwhile, what is left stays kept for the next resume.
+func (c *connection) replay() {
+	for {
+		c.Lock()
+		if c.closeCode != 0 {
+			c.Unlock()
+			return
+		}
+	queue:
+		for len(c.missed) > 0 {
+			select {
+			case c.send <- c.missed[0]:
+				c.missed = c.missed[1:]
+			default:
+				break queue
+			}
+		}
+		if len(c.missed) == 0 {
+			c.detached = false
+			c.missed = nil
+			c.missedDropped = 0
+			c.Unlock()
+			return
+		}
+		c.Unlock()
+
+		select {
+		case <-c.done:
+		case <-time.After(replayWait):
+		}
+	}
+}
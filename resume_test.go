@@ -0,0 +1,243 @@
+// Copyright (c) 2016, RetailNext, Inc.
+// This material contains trade secrets and confidential information of
+// RetailNext, Inc.  Any use, reproduction, disclosure or dissemination
+// is strictly prohibited without the explicit written permission
+// of RetailNext, Inc.
+// All rights reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type testCommand struct {
+	Command string          `json:"command"`
+	Args    json.RawMessage `json:"args"`
+}
+
+// applyDefaults installs the default config once, as writer goroutines of
+// earlier tests may still be reading it.
+var applyDefaults sync.Once
+
+func newTestServer(t *testing.T) (*server, string) {
+	cfg := defaultConfig()
+	applyDefaults.Do(cfg.apply)
+	s := newServer(cfg)
+
+	ts := httptest.NewServer(http.HandlerFunc(s.handleConnect))
+	t.Cleanup(func() {
+		close(s.stop)
+		s.conns.Wait()
+		ts.Close()
+	})
+	return s, "ws" + strings.TrimPrefix(ts.URL, "http")
+}
+
+func dial(t *testing.T, url string, first testCommand) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := conn.WriteJSON(first); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// await reads from conn until it gets command, failing the test if it does
+// not within a second.
+func await(t *testing.T, conn *websocket.Conn, command string, args interface{}) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		var got testCommand
+		if err := conn.ReadJSON(&got); err != nil {
+			t.Fatalf("waiting for %s: %s", command, err)
+		}
+		if got.Command == command {
+			if args != nil {
+				if err := json.Unmarshal(got.Args, args); err != nil {
+					t.Fatal(err)
+				}
+			}
+			return
+		}
+	}
+}
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// awaitHeld waits for the dropped connection holding token to be ready to
+// resume.
+func awaitHeld(t *testing.T, s *server, token string) {
+	t.Helper()
+	eventually(t, "the dropped connection to await a resume", func() bool {
+		s.RLock()
+		defer s.RUnlock()
+		c := s.resumable[token]
+		if c == nil {
+			return false
+		}
+		c.RLock()
+		defer c.RUnlock()
+		return c.resumed != nil
+	})
+}
+
+// TestResumeAttached resumes a dropped tab of a user from a new connection
+// made as the same user, which is attached to the user's client before it
+// asks to resume.
+func TestResumeAttached(t *testing.T) {
+	s, url := newTestServer(t)
+	if err := s.users.register("kirk", "enterprise"); err != nil {
+		t.Fatal(err)
+	}
+	session, _, err := s.sessions.create("kirk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kirkURL := url + "?token=" + session
+	hello := testCommand{Command: "hello", Args: json.RawMessage(`{"version":2}`)}
+
+	var welcome welcomeArgs
+	dropping := dial(t, kirkURL, hello)
+	await(t, dropping, "welcome", &welcome)
+	staying := dial(t, kirkURL, hello)
+	await(t, staying, "welcome", nil)
+
+	dropping.UnderlyingConn().Close()
+	awaitHeld(t, s, welcome.ResumeToken)
+
+	args, _ := json.Marshal(resumeArgs{Token: welcome.ResumeToken, Version: 2})
+	resuming := dial(t, kirkURL, testCommand{Command: "resume", Args: args})
+	var resumed welcomeArgs
+	await(t, resuming, "welcome", &resumed)
+	if !resumed.Resumed || resumed.Name != "kirk" {
+		t.Fatalf("got welcome %+v, want kirk resumed", resumed)
+	}
+
+	s.RLock()
+	wc, _ := s.clients["kirk"].(*webClient)
+	s.RUnlock()
+	if wc == nil {
+		t.Fatal("kirk was removed by the resume")
+	}
+	if rooms := s.roomsOf("kirk"); len(rooms) != 1 || rooms[0] != defaultRoom {
+		t.Fatalf("kirk is in %v, want just %s", rooms, defaultRoom)
+	}
+	wc.RLock()
+	conns := len(wc.conns)
+	wc.RUnlock()
+	if conns != 2 {
+		t.Fatalf("kirk has %d connections, want 2", conns)
+	}
+
+	// A name of its own, so its message is not enhanced.
+	guest := dial(t, url+"?name=sulu", hello)
+	await(t, guest, "welcome", nil)
+	msg := testCommand{Command: "send_message", Args: json.RawMessage(`{"room":"bridge","message":"engage"}`)}
+	if err := guest.WriteJSON(msg); err != nil {
+		t.Fatal(err)
+	}
+	for _, conn := range []*websocket.Conn{staying, resuming} {
+		var got messageArgs
+		await(t, conn, "message", &got)
+		if got.Message != "engage" {
+			t.Fatalf("got message %q, want engage", got.Message)
+		}
+	}
+}
+
+// TestCloseWithoutStatus checks that a close frame with no status code, as
+// a browser sends for ws.close(), is not taken for a drop.
+func TestCloseWithoutStatus(t *testing.T) {
+	s, url := newTestServer(t)
+	hello := testCommand{Command: "hello", Args: json.RawMessage(`{"version":2}`)}
+
+	var welcome welcomeArgs
+	conn := dial(t, url, hello)
+	await(t, conn, "welcome", &welcome)
+	if err := conn.WriteMessage(websocket.CloseMessage, nil); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, welcome.Name+" to be removed", func() bool {
+		s.RLock()
+		defer s.RUnlock()
+		return s.clients[welcome.Name] == nil && s.resumable[welcome.ResumeToken] == nil
+	})
+}
+
+// TestResumeNamedGuest resumes a guest that picked its name, and so
+// reconnects asking for the name it still holds.
+func TestResumeNamedGuest(t *testing.T) {
+	s, url := newTestServer(t)
+	hello := testCommand{Command: "hello", Args: json.RawMessage(`{"version":2}`)}
+
+	var welcome welcomeArgs
+	dropping := dial(t, url+"?name=spock", hello)
+	await(t, dropping, "welcome", &welcome)
+	dropping.UnderlyingConn().Close()
+	awaitHeld(t, s, welcome.ResumeToken)
+
+	args, _ := json.Marshal(resumeArgs{Token: welcome.ResumeToken, Version: 2})
+	resuming := dial(t, url+"?name=spock&resume="+welcome.ResumeToken, testCommand{Command: "resume", Args: args})
+	var resumed welcomeArgs
+	await(t, resuming, "welcome", &resumed)
+	if !resumed.Resumed || resumed.Name != "spock" {
+		t.Fatalf("got welcome %+v, want spock resumed", resumed)
+	}
+
+	// Without the token the name is still taken.
+	_, resp, err := websocket.DefaultDialer.Dial(url+"?name=spock", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusConflict {
+		t.Fatalf("dialing as spock again: got %v, want %d", err, http.StatusConflict)
+	}
+}
+
+// TestKickWhileHeld kicks a user whose only connection dropped, and checks
+// that the user is removed and cannot resume.
+func TestKickWhileHeld(t *testing.T) {
+	s, url := newTestServer(t)
+	hello := testCommand{Command: "hello", Args: json.RawMessage(`{"version":2}`)}
+
+	var welcome welcomeArgs
+	dropping := dial(t, url+"?name=spock", hello)
+	await(t, dropping, "welcome", &welcome)
+	dropping.UnderlyingConn().Close()
+	awaitHeld(t, s, welcome.ResumeToken)
+
+	if err := s.moderate("admin", "kick", moderationArgs{Name: "spock"}); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "spock to be removed", func() bool {
+		s.RLock()
+		defer s.RUnlock()
+		return s.clients["spock"] == nil
+	})
+
+	args, _ := json.Marshal(resumeArgs{Token: welcome.ResumeToken, Version: 2})
+	resuming := dial(t, url, testCommand{Command: "resume", Args: args})
+	var resumed welcomeArgs
+	await(t, resuming, "welcome", &resumed)
+	if resumed.Resumed || resumed.Name == "spock" {
+		t.Fatalf("got welcome %+v, want a fresh guest", resumed)
+	}
+}
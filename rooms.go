@@ -0,0 +1,142 @@
+// Copyright (c) 2016, RetailNext, Inc.
+// This material contains trade secrets and confidential information of
+// RetailNext, Inc.  Any use, reproduction, disclosure or dissemination
+// is strictly prohibited without the explicit written permission
+// of RetailNext, Inc.
+// All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+const defaultRoom = "bridge"
+
+var roomNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+type roomArgs struct {
+	Room string `json:"room" schema:"required"`
+}
+
+func (a roomArgs) validate() error {
+	if !roomNamePattern.MatchString(a.Room) {
+		return fmt.Errorf("invalid room name %q", a.Room)
+	}
+	return nil
+}
+
+type roomInfo struct {
+	Name    string `json:"name"`
+	Members int    `json:"members"`
+}
+
+// roomsArgs answers list_rooms.
+type roomsArgs struct {
+	Rooms []roomInfo `json:"rooms"`
+}
+
+func (s *server) joinRoom(c Client, room string) error {
+	if !roomNamePattern.MatchString(room) {
+		return fmt.Errorf("invalid room name %q", room)
+	}
+
+	s.Lock()
+	members := s.rooms[room]
+	if members == nil {
+		members = make(map[string]Client)
+		s.rooms[room] = members
+	}
+	_, already := members[c.Name()]
+	members[c.Name()] = c
+	s.Unlock()
+
+	if already {
+		return fmt.Errorf("already in room %s", room)
+	}
+
+	s.broadcastUsers(room)
+	return nil
+}
+
+func (s *server) leaveRoom(c Client, room string) error {
+	s.Lock()
+	members := s.rooms[room]
+	if members[c.Name()] == nil {
+		s.Unlock()
+		return fmt.Errorf("not in room %s", room)
+	}
+	delete(members, c.Name())
+	if len(members) == 0 && room != defaultRoom {
+		delete(s.rooms, room)
+	}
+	s.Unlock()
+
+	s.broadcastUsers(room)
+	return nil
+}
+
+// leaveAllRooms removes name from every room and returns the rooms it was in.
+// The caller must hold the server lock.
+func (s *server) leaveAllRooms(name string) []string {
+	var left []string
+	for room, members := range s.rooms {
+		if members[name] == nil {
+			continue
+		}
+		delete(members, name)
+		if len(members) == 0 && room != defaultRoom {
+			delete(s.rooms, room)
+		}
+		left = append(left, room)
+	}
+	return left
+}
+
+func (s *server) inRoom(name, room string) bool {
+	s.RLock()
+	defer s.RUnlock()
+	return s.rooms[room][name] != nil
+}
+
+// roomsOf returns the rooms name is a member of.
+func (s *server) roomsOf(name string) []string {
+	var rooms []string
+	s.RLock()
+	for room, members := range s.rooms {
+		if members[name] != nil {
+			rooms = append(rooms, room)
+		}
+	}
+	s.RUnlock()
+	sort.Strings(rooms)
+	return rooms
+}
+
+// sendRooms sends c the members and history of each room it is in.
+func (s *server) sendRooms(c Client) error {
+	for i, room := range s.roomsOf(c.Name()) {
+		if err := c.SendCommand("users", s.usersIn(room)); err != nil {
+			return err
+		}
+		if err := s.sendHistory(c, room, i == 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *server) listRooms() []roomInfo {
+	var rooms []roomInfo
+	s.RLock()
+	for name, members := range s.rooms {
+		rooms = append(rooms, roomInfo{Name: name, Members: len(members)})
+	}
+	s.RUnlock()
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].Name < rooms[j].Name
+	})
+	return rooms
+}
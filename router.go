@@ -0,0 +1,292 @@
+// Copyright (c) 2016, RetailNext, Inc.
+// This material contains trade secrets and confidential information of
+// RetailNext, Inc.  Any use, reproduction, disclosure or dissemination
+// is strictly prohibited without the explicit written permission
+// of RetailNext, Inc.
+// All rights reserved.
+
+package main
+
+import (
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// route is a command clients can send: the type of its args, which are
+// checked by their validate method if they have one, and its handler.
+type route struct {
+	doc  string
+	args reflect.Type
+	run  func(s *server, c *connection, raw json.RawMessage) (string, interface{}, error)
+}
+
+// commandHandler handles a command with args of type A, returning the
+// command to reply with, if any.
+type commandHandler[A any] func(s *server, c *connection, args *A) (string, interface{}, error)
+
+type validator interface {
+	validate() error
+}
+
+func newRoute[A any](doc string, h commandHandler[A]) route {
+	return route{
+		doc:  doc,
+		args: reflect.TypeOf((*A)(nil)).Elem(),
+		run: func(s *server, c *connection, raw json.RawMessage) (string, interface{}, error) {
+			args := new(A)
+			if len(raw) > 0 {
+				if err := json.Unmarshal(raw, args); err != nil {
+					return "", nil, fmt.Errorf("invalid args: %s", err)
+				}
+			}
+			if v, ok := interface{}(args).(validator); ok {
+				if err := v.validate(); err != nil {
+					return "", nil, err
+				}
+			}
+			return h(s, c, args)
+		},
+	}
+}
+
+// noArgs is the args of commands that take none.
+type noArgs struct{}
+
+// commandError is the args of the error command. Handlers can return one
+// to add details to the error.
+type commandError struct {
+	Command   string `json:"command,omitempty"`
+	Message   string `json:"message"`
+	ClientKey string `json:"client_key,omitempty"`
+}
+
+func (e *commandError) Error() string {
+	return e.Message
+}
+
+var routes map[string]route
+
+func init() {
+	routes = map[string]route{
+		"hello":        newRoute("Say which protocol version and features the client supports. Must be the first command; clients that skip it speak version 1.", (*server).cmdHello),
+		"resume":       newRoute("Take back your name after a dropped connection, with the token from welcome, and get what was missed. Instead of hello; a connection that cannot resume is welcomed afresh.", (*server).cmdResume),
+		"send_message": newRoute("Send a message to a room, or privately to a user. Messages starting with / are slash commands.", (*server).cmdSendMessage),
+		"join_room":    newRoute("Join a room, creating it if need be.", (*server).cmdJoinRoom),
+		"leave_room":   newRoute("Leave a room.", (*server).cmdLeaveRoom),
+		"list_rooms":   newRoute("List the rooms and how many members each has.", (*server).cmdListRooms),
+		"set_name":     newRoute("Change the name of a guest.", (*server).cmdSetName),
+		"set_presence": newRoute("Set your presence to online, away or busy.", (*server).cmdSetPresence),
+		"typing":       newRoute("Tell a room or user that you started or stopped typing.", (*server).cmdTyping),
+
+		"edit_message":   newRoute("Edit one of your messages, or anyone's as an admin.", (*server).cmdEditMessage),
+		"delete_message": newRoute("Delete one of your messages, or anyone's as an admin.", (*server).cmdDeleteMessage),
+		"get_thread":     newRoute("Get the thread a message belongs to.", (*server).cmdGetThread),
+		"react":          newRoute("React to a message with an emoji.", reactCommand(true)),
+		"unreact":        newRoute("Take back a reaction to a message.", reactCommand(false)),
+
+		"kick":  newRoute("Disconnect a user. Admins only.", moderationCommand("kick")),
+		"mute":  newRoute("Stop a user sending messages for a while. Admins only.", moderationCommand("mute")),
+		"ban":   newRoute("Ban a user, for a while or for good. Admins only.", moderationCommand("ban")),
+		"unban": newRoute("Lift a ban. Admins only.", moderationCommand("unban")),
+	}
+}
+
+// dispatch runs the handler for command and returns the command to reply
+// with, if any. Failures are returned as a *commandError.
+func (s *server) dispatch(c *connection, command commandFromClient) (string, interface{}, error) {
+	r, ok := routes[command.Command]
+	if !ok {
+		return "", nil, &commandError{
+			Command: command.Command,
+			Message: fmt.Sprintf("unknown command %q", command.Command),
+		}
+	}
+
+	reply, args, err := r.run(s, c, command.Args)
+	if err != nil {
+		var ce *commandError
+		if !errors.As(err, &ce) {
+			ce = &commandError{Message: err.Error()}
+		}
+		ce.Command = command.Command
+		return "", nil, ce
+	}
+	return reply, args, nil
+}
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// schemaOf describes values of type t as encoded by encoding/json. Struct
+// fields tagged schema:"required" must be given, and schema:"readonly"
+// fields are filled in by the server.
+func schemaOf(t reflect.Type) map[string]interface{} {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Implements(textMarshalerType):
+		return map[string]interface{}{"type": "string"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem())}
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		required := []string{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if f.PkgPath != "" || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+
+			prop := schemaOf(f.Type)
+			switch f.Tag.Get("schema") {
+			case "required":
+				required = append(required, name)
+			case "readonly":
+				prop["readOnly"] = true
+			}
+			properties[name] = prop
+		}
+		schema := map[string]interface{}{
+			"type":       "object",
+			"properties": properties,
+		}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema
+	}
+	return map[string]interface{}{}
+}
+
+// serverCommand is a command the server sends clients: what it means and
+// the type of its args. It is only used to describe the protocol.
+type serverCommand struct {
+	doc  string
+	args reflect.Type
+}
+
+var serverCommands = map[string]serverCommand{
+	"welcome":         {"Sent first, answering hello or resume, or once a client that skipped hello sends another command.", reflect.TypeOf(welcomeArgs{})},
+	"error":           {"A command failed.", reflect.TypeOf(commandError{})},
+	"ack":             {"Answers send_message once the message is sent.", reflect.TypeOf(delivery{})},
+	"message":         {"A message to a room you are in, or privately to you. Your own messages come back with from_me set.", reflect.TypeOf(messageArgs{})},
+	"history":         {"The recent messages of a room you joined, and on connecting your private ones.", reflect.TypeOf(historyArgs{})},
+	"users":           {"Who is in a room. Clients without the presence capability get plain names.", reflect.TypeOf(usersArgs{})},
+	"joined_room":     {"You joined a room.", reflect.TypeOf(roomArgs{})},
+	"left_room":       {"You left a room.", reflect.TypeOf(roomArgs{})},
+	"switched_room":   {"Answers /switch: show the room and send to it from now on.", reflect.TypeOf(roomArgs{})},
+	"rooms":           {"Answers list_rooms.", reflect.TypeOf(roomsArgs{})},
+	"renamed":         {"A user sharing a room or conversation with you changed their name.", reflect.TypeOf(renamedArgs{})},
+	"typing":          {"Someone started or stopped typing to a room or to you.", reflect.TypeOf(typingNotice{})},
+	"message_edited":  {"A message you can see was edited.", reflect.TypeOf(messageArgs{})},
+	"message_deleted": {"A message you can see was deleted.", reflect.TypeOf(deletedArgs{})},
+	"reaction_update": {"The reactions to a message you can see changed.", reflect.TypeOf(reactionUpdate{})},
+	"thread":          {"Answers get_thread.", reflect.TypeOf(threadArgs{})},
+	"mention":         {"A message mentioning you.", reflect.TypeOf(messageArgs{})},
+	"command_output":  {"The output of a slash command.", reflect.TypeOf(commandOutputArgs{})},
+	"moderated":       {"Answers a moderation command.", reflect.TypeOf(moderatedArgs{})},
+	"moderation":      {"An admin kicked, muted or banned you.", reflect.TypeOf(moderationNotice{})},
+	"server_shutdown": {"The server is going away.", reflect.TypeOf(shutdownArgs{})},
+}
+
+// commandSchema describes the command name, with args of type args, as
+// JSON Schema.
+func commandSchema(name, doc string, args reflect.Type) map[string]interface{} {
+	return map[string]interface{}{
+		"title":       name,
+		"description": doc,
+		"type":        "object",
+		"properties": map[string]interface{}{
+			"command": map[string]interface{}{"const": name},
+			"args":    schemaOf(args),
+		},
+		"required": []string{"command"},
+	}
+}
+
+// protocolSchema describes every command clients can send, and every one
+// the server sends them, as JSON Schema.
+func protocolSchema() map[string]interface{} {
+	var names []string
+	for name := range routes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fromClient := make([]interface{}, len(names))
+	for i, name := range names {
+		fromClient[i] = commandSchema(name, routes[name].doc, routes[name].args)
+	}
+
+	names = names[:0]
+	for name := range serverCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	toClient := make([]interface{}, len(names))
+	for i, name := range names {
+		doc := serverCommands[name].doc
+		if capability, ok := commandCapabilities[name]; ok {
+			doc += fmt.Sprintf(" Only sent to clients with the %s capability.", capability)
+		}
+		toClient[i] = commandSchema(name, doc, serverCommands[name].args)
+	}
+
+	return map[string]interface{}{
+		"$schema":     "https://json-schema.org/draft/2020-12/schema",
+		"title":       "trekchat protocol",
+		"description": "Commands sent both ways as JSON text messages over the websocket at /connect.",
+		"$defs": map[string]interface{}{
+			"client_command": map[string]interface{}{
+				"description": "Commands clients send.",
+				"oneOf":       fromClient,
+			},
+			"server_command": map[string]interface{}{
+				"description": "Commands the server sends clients.",
+				"oneOf":       toClient,
+			},
+		},
+		// typing is sent both ways, so a command may match either.
+		"anyOf": []interface{}{
+			map[string]interface{}{"$ref": "#/$defs/client_command"},
+			map[string]interface{}{"$ref": "#/$defs/server_command"},
+		},
+	}
+}
+
+func serveSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(protocolSchema())
+}
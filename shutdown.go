@@ -0,0 +1,102 @@
+// Copyright (c) 2016, RetailNext, Inc.
+// This material contains trade secrets and confidential information of
+// RetailNext, Inc.  Any use, reproduction, disclosure or dissemination
+// is strictly prohibited without the explicit written permission
+// of RetailNext, Inc.
+// All rights reserved.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/gorilla/websocket"
+)
+
+var errShuttingDown = errors.New("server is shutting down")
+
+func (s *server) isShuttingDown() bool {
+	s.RLock()
+	defer s.RUnlock()
+	return s.shuttingDown
+}
+
+// disconnect closes c's connections with a close frame carrying code and
+// reason, and stops any that dropped being resumed. Clients without a
+// connection, like bots, are just removed.
+func (s *server) disconnect(c Client, code int, reason string) {
+	if wc, ok := c.(*webClient); ok {
+		s.release(wc)
+		wc.close(code, reason)
+		return
+	}
+	s.removeClient(c.Name())
+}
+
+// shutdownArgs tell clients the server is going away, and why.
+type shutdownArgs struct {
+	Reason string `json:"reason"`
+}
+
+// shutdown refuses new clients, stops the bots, tells every connected
+// client why it is being disconnected and waits for their connections to
+// drain or ctx to expire before flushing stats and history.
+func (s *server) shutdown(ctx context.Context, reason string) {
+	s.Lock()
+	s.shuttingDown = true
+	clients := make([]Client, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.Unlock()
+
+	close(s.stop)
+	s.bots.Wait()
+
+	for _, c := range clients {
+		if _, ok := c.(*webClient); !ok {
+			continue
+		}
+		if err := c.SendCommand("server_shutdown", shutdownArgs{Reason: reason}); err != nil {
+			log.Printf("Failed notifying %s of shutdown: %s", c.Name(), err)
+		}
+		s.disconnect(c, websocket.CloseGoingAway, reason)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		s.conns.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		log.Printf("Gave up waiting for connections to close: %s", ctx.Err())
+	}
+
+	s.flushStats()
+	if err := s.history.Close(); err != nil {
+		log.Printf("error closing history: %s", err)
+	}
+	if err := s.audit.Close(); err != nil {
+		log.Printf("error closing audit log: %s", err)
+	}
+}
+
+// flushStats saves the stats of every authenticated client still connected.
+func (s *server) flushStats() {
+	var names []string
+	s.RLock()
+	for name, c := range s.clients {
+		if wc, ok := c.(*webClient); ok && wc.authenticated {
+			names = append(names, name)
+		}
+	}
+	s.RUnlock()
+
+	for _, name := range names {
+		s.saveAccountStats(name)
+	}
+}
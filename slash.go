@@ -0,0 +1,448 @@
+// Copyright (c) 2016, RetailNext, Inc.
+// This material contains trade secrets and confidential information of
+// RetailNext, Inc.  Any use, reproduction, disclosure or dissemination
+// is strictly prohibited without the explicit written permission
+// of RetailNext, Inc.
+// All rights reserved.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// slashCommand handles messages starting with /name. It returns true if
+// msg, which it may have rewritten, should then be sent as usual.
+type slashCommand struct {
+	usage string
+	help  string
+	run   func(s *server, c Client, msg *messageArgs, args string) (bool, error)
+}
+
+var slashCommands map[string]slashCommand
+
+func init() {
+	slashCommands = map[string]slashCommand{
+		"dm": {
+			usage: "/dm <name> <message>",
+			help:  "send a private message",
+			run:   slashDM,
+		},
+		"me": {
+			usage: "/me <action>",
+			help:  "describe what you are doing",
+			run:   slashMe,
+		},
+		"nick": {
+			usage: "/nick <name>",
+			help:  "change your name",
+			run:   slashNick,
+		},
+		"who": {
+			usage: "/who [room]",
+			help:  "list the users in a room",
+			run:   slashWho,
+		},
+		"whois": {
+			usage: "/whois <name>",
+			help:  "describe a user",
+			run:   slashWhois,
+		},
+		"away": {
+			usage: "/away",
+			help:  "mark yourself away, or back if you already are",
+			run:   slashAway,
+		},
+		"busy": {
+			usage: "/busy",
+			help:  "mark yourself busy",
+			run:   slashPresence("busy"),
+		},
+		"back": {
+			usage: "/back",
+			help:  "mark yourself online again",
+			run:   slashPresence("online"),
+		},
+		"join": {
+			usage: "/join <room>",
+			help:  "join a room, creating it if need be",
+			run:   slashJoin,
+		},
+		"leave": {
+			usage: "/leave [room]",
+			help:  "leave a room, by default the current one",
+			run:   slashLeave,
+		},
+		"switch": {
+			usage: "/switch <room>",
+			help:  "send to and show the users of another room you are in",
+			run:   slashSwitch,
+		},
+		"rooms": {
+			usage: "/rooms",
+			help:  "list the rooms",
+			run:   slashRooms,
+		},
+		"edit": {
+			usage: "/edit <message>",
+			help:  "edit the message you reply to, or else your last one",
+			run:   slashEdit,
+		},
+		"delete": {
+			usage: "/delete",
+			help:  "delete the message you reply to, or else your last one",
+			run:   slashDelete,
+		},
+		"react": {
+			usage: "/react <emoji>",
+			help:  "react to the message you reply to",
+			run:   slashReact(true),
+		},
+		"unreact": {
+			usage: "/unreact <emoji>",
+			help:  "take back a reaction to the message you reply to",
+			run:   slashReact(false),
+		},
+		"thread": {
+			usage: "/thread",
+			help:  "show the thread of the message you reply to",
+			run:   slashThread,
+		},
+		"kick": {
+			usage: "/kick <name> [reason]",
+			help:  "disconnect a user, admins only",
+			run:   slashModerate("kick"),
+		},
+		"mute": {
+			usage: "/mute <name> <duration> [reason]",
+			help:  "stop a user sending messages for a while, admins only",
+			run:   slashModerate("mute"),
+		},
+		"ban": {
+			usage: "/ban <name> [reason]",
+			help:  "ban a user for good, admins only",
+			run:   slashModerate("ban"),
+		},
+		"unban": {
+			usage: "/unban <name>",
+			help:  "lift a ban, admins only",
+			run:   slashModerate("unban"),
+		},
+		"help": {
+			usage: "/help [command]",
+			help:  "describe the commands",
+			run:   slashHelp,
+		},
+	}
+}
+
+// slashCommand runs the command in msg, which starts with a slash. A
+// message starting with two slashes is sent as is, less the first slash.
+func (s *server) slashCommand(c Client, msg *messageArgs) (bool, error) {
+	text := strings.TrimPrefix(msg.Message, "/")
+	if strings.HasPrefix(text, "/") {
+		msg.Message = text
+		return true, nil
+	}
+
+	fields := strings.SplitN(text, " ", 2)
+	cmd, ok := slashCommands[fields[0]]
+	if !ok {
+		return false, fmt.Errorf("unknown command /%s, try /help", fields[0])
+	}
+	var args string
+	if len(fields) > 1 {
+		args = strings.TrimSpace(fields[1])
+	}
+	return cmd.run(s, c, msg, args)
+}
+
+// commandOutputArgs carry the text output of a slash command.
+type commandOutputArgs struct {
+	Command string `json:"command"`
+	Output  string `json:"output"`
+}
+
+// commandOutput sends the text output of a slash command to c.
+func commandOutput(c Client, command, output string) error {
+	return c.SendCommand("command_output", commandOutputArgs{Command: command, Output: output})
+}
+
+func usageError(command string) error {
+	return fmt.Errorf("usage: %s", slashCommands[command].usage)
+}
+
+// runCommand runs the handler of a command people can send, with args, for
+// c, and sends c the reply if there is one. Slash commands that stand for
+// such a command use it, so the two are checked alike.
+func runCommand[A any](s *server, c Client, h commandHandler[A], args A) error {
+	conn, ok := c.(*connection)
+	if !ok {
+		return errors.New("only people can do that")
+	}
+	if v, ok := interface{}(args).(validator); ok {
+		if err := v.validate(); err != nil {
+			return err
+		}
+	}
+	reply, replyArgs, err := h(s, conn, &args)
+	if err != nil || reply == "" {
+		return err
+	}
+	return conn.SendCommand(reply, replyArgs)
+}
+
+// targetMessage returns the message a slash command acting on one is meant
+// for: the one msg replies to, or else c's last.
+func targetMessage(c Client, msg *messageArgs) int64 {
+	if msg.ReplyTo != 0 {
+		return msg.ReplyTo
+	}
+	if conn, ok := c.(*connection); ok {
+		conn.client.RLock()
+		defer conn.client.RUnlock()
+		return conn.client.lastSent
+	}
+	return 0
+}
+
+func slashDM(s *server, c Client, msg *messageArgs, args string) (bool, error) {
+	fields := strings.SplitN(args, " ", 2)
+	if len(fields) < 2 || strings.TrimSpace(fields[1]) == "" {
+		return false, usageError("dm")
+	}
+	msg.Private = true
+	msg.Recipient = fields[0]
+	msg.Message = strings.TrimSpace(fields[1])
+	return true, nil
+}
+
+func slashMe(s *server, c Client, msg *messageArgs, args string) (bool, error) {
+	if args == "" {
+		return false, usageError("me")
+	}
+	msg.Message = args
+	msg.Action = true
+	return true, nil
+}
+
+func slashNick(s *server, c Client, msg *messageArgs, args string) (bool, error) {
+	if args == "" {
+		return false, usageError("nick")
+	}
+	conn, ok := c.(*connection)
+	if !ok {
+		return false, errors.New("only people can change their name")
+	}
+	return false, s.renameClient(conn.client, args)
+}
+
+func slashWho(s *server, c Client, msg *messageArgs, args string) (bool, error) {
+	room := args
+	if room == "" {
+		room = msg.Room
+	}
+	if room == "" {
+		room = defaultRoom
+	}
+
+	var users []userInfo
+	s.RLock()
+	for _, member := range s.rooms[room] {
+		users = append(users, userInfoOf(member))
+	}
+	s.RUnlock()
+	if len(users) == 0 {
+		return false, fmt.Errorf("no such room %s", room)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Name < users[j].Name
+	})
+
+	names := make([]string, len(users))
+	for i, u := range users {
+		names[i] = u.Name
+		if u.Presence != "online" {
+			names[i] += " (" + u.Presence + ")"
+		}
+	}
+	return false, commandOutput(c, "who", fmt.Sprintf("#%s: %s", room, strings.Join(names, ", ")))
+}
+
+func slashWhois(s *server, c Client, msg *messageArgs, args string) (bool, error) {
+	if args == "" {
+		return false, usageError("whois")
+	}
+
+	s.RLock()
+	target := s.clients[args]
+	s.RUnlock()
+	if target == nil {
+		return false, fmt.Errorf("%s is not connected", args)
+	}
+
+	info := userInfoOf(target)
+	kind := "guest"
+	if info.Bot {
+		kind = "bot"
+	} else if s.isAdmin(target) {
+		kind = "admin"
+	} else if wc, ok := target.(*webClient); ok && wc.authenticated {
+		kind = "registered user"
+	}
+
+	out := fmt.Sprintf("%s is a %s, %s", info.Name, kind, info.Presence)
+	if !info.LastActive.IsZero() {
+		out += fmt.Sprintf(", last active %s ago", time.Since(info.LastActive).Round(time.Second))
+	}
+	if rooms := s.roomsOf(info.Name); len(rooms) > 0 {
+		out += ", in #" + strings.Join(rooms, ", #")
+	}
+	return false, commandOutput(c, "whois", out)
+}
+
+func slashAway(s *server, c Client, msg *messageArgs, args string) (bool, error) {
+	conn, ok := c.(*connection)
+	if !ok {
+		return false, errors.New("bots are never away")
+	}
+	wc := conn.client
+
+	presence := "away"
+	if wc.info().Presence == "away" {
+		presence = "online"
+	}
+	if err := s.setPresence(wc, presence); err != nil {
+		return false, err
+	}
+	return false, commandOutput(c, "away", "You are now "+presence)
+}
+
+func slashPresence(presence string) func(s *server, c Client, msg *messageArgs, args string) (bool, error) {
+	return func(s *server, c Client, msg *messageArgs, args string) (bool, error) {
+		if err := runCommand(s, c, (*server).cmdSetPresence, presenceArgs{Presence: presence}); err != nil {
+			return false, err
+		}
+		return false, commandOutput(c, presence, "You are now "+presence)
+	}
+}
+
+func slashJoin(s *server, c Client, msg *messageArgs, args string) (bool, error) {
+	if args == "" {
+		return false, usageError("join")
+	}
+	return false, runCommand(s, c, (*server).cmdJoinRoom, roomArgs{Room: args})
+}
+
+func slashLeave(s *server, c Client, msg *messageArgs, args string) (bool, error) {
+	room := args
+	if room == "" {
+		room = msg.Room
+	}
+	if room == "" {
+		return false, usageError("leave")
+	}
+	return false, runCommand(s, c, (*server).cmdLeaveRoom, roomArgs{Room: room})
+}
+
+func slashSwitch(s *server, c Client, msg *messageArgs, args string) (bool, error) {
+	if args == "" {
+		return false, usageError("switch")
+	}
+	if !s.inRoom(c.Name(), args) {
+		return false, fmt.Errorf("you are not in #%s, try /join %s", args, args)
+	}
+	return false, c.SendCommand("switched_room", roomArgs{Room: args})
+}
+
+func slashRooms(s *server, c Client, msg *messageArgs, args string) (bool, error) {
+	return false, runCommand(s, c, (*server).cmdListRooms, noArgs{})
+}
+
+func slashEdit(s *server, c Client, msg *messageArgs, args string) (bool, error) {
+	id := targetMessage(c, msg)
+	if args == "" || id == 0 {
+		return false, usageError("edit")
+	}
+	return false, runCommand(s, c, (*server).cmdEditMessage, editArgs{ID: id, Message: args})
+}
+
+func slashDelete(s *server, c Client, msg *messageArgs, args string) (bool, error) {
+	id := targetMessage(c, msg)
+	if id == 0 {
+		return false, errors.New("no message to delete, reply to one")
+	}
+	return false, runCommand(s, c, (*server).cmdDeleteMessage, messageIDArgs{ID: id})
+}
+
+func slashReact(add bool) func(s *server, c Client, msg *messageArgs, args string) (bool, error) {
+	command := "react"
+	if !add {
+		command = "unreact"
+	}
+	return func(s *server, c Client, msg *messageArgs, args string) (bool, error) {
+		if args == "" || msg.ReplyTo == 0 {
+			return false, usageError(command)
+		}
+		return false, runCommand(s, c, reactCommand(add), reactionArgs{ID: msg.ReplyTo, Emoji: args})
+	}
+}
+
+func slashThread(s *server, c Client, msg *messageArgs, args string) (bool, error) {
+	if msg.ReplyTo == 0 {
+		return false, errors.New("reply to a message to see its thread")
+	}
+	return false, runCommand(s, c, (*server).cmdGetThread, messageIDArgs{ID: msg.ReplyTo})
+}
+
+// slashModerate parses the name, the duration of a mute and the reason
+// after the moderation command action.
+func slashModerate(action string) func(s *server, c Client, msg *messageArgs, args string) (bool, error) {
+	return func(s *server, c Client, msg *messageArgs, args string) (bool, error) {
+		fields := strings.SplitN(args, " ", 2)
+		if fields[0] == "" {
+			return false, usageError(action)
+		}
+		a := moderationArgs{Name: fields[0]}
+		if len(fields) > 1 {
+			a.Reason = strings.TrimSpace(fields[1])
+		}
+		if action == "mute" {
+			fields = strings.SplitN(a.Reason, " ", 2)
+			if err := a.Duration.UnmarshalText([]byte(fields[0])); err != nil {
+				return false, usageError(action)
+			}
+			a.Reason = ""
+			if len(fields) > 1 {
+				a.Reason = strings.TrimSpace(fields[1])
+			}
+		}
+		return false, runCommand(s, c, moderationCommand(action), a)
+	}
+}
+
+func slashHelp(s *server, c Client, msg *messageArgs, args string) (bool, error) {
+	if args != "" {
+		cmd, ok := slashCommands[strings.TrimPrefix(args, "/")]
+		if !ok {
+			return false, fmt.Errorf("unknown command /%s", args)
+		}
+		return false, commandOutput(c, "help", cmd.usage+": "+cmd.help)
+	}
+
+	var names []string
+	for name := range slashCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := make([]string, len(names))
+	for i, name := range names {
+		lines[i] = slashCommands[name].usage + ": " + slashCommands[name].help
+	}
+	return false, commandOutput(c, "help", strings.Join(lines, "\n"))
+}
@@ -1,62 +1,228 @@
 (function() {
 
   var ws;
+  var my_name;
+  var current_room = "bridge";
+  var room_users = {};
+  var typing_users = {};
+  var last_typing = 0;
 
-  var broadcast_message = function(message) {
+  // Every message carries a client key so the server can drop resends.
+  var key_prefix = Math.random().toString(36).slice(2);
+  var key_count = 0;
+  var reply_to;
+
+  // Set by welcome; sent on reconnecting after a dropped connection to
+  // keep our name and get what we missed.
+  var resume_token;
+  var features = ["acks", "edits", "mentions", "presence", "reactions",
+                  "slash_commands", "threads", "typing"];
+
+  var set_reply_to = function(id, sender) {
+    reply_to = id;
+    $("input.chat-input").attr("placeholder", id ? "Reply to " + sender + " (Esc to cancel)" : "Type something");
+  };
+  var next_client_key = function() {
+    key_count++;
+    return key_prefix + "-" + key_count;
+  };
+
+  var send_command = function(command, args) {
     ws.send(JSON.stringify({
-      command: "send_message",
-      args: {
-        message: message
-      }
+      command: command,
+      args: args
     }));
   };
 
-  var private_message = function(recipient, message) {
-    ws.send(JSON.stringify({
-      command: "send_message",
-      args: {
-        message: message,
-        recipient: recipient,
-        private: true
+  var broadcast_message = function(message) {
+    send_command("send_message", {
+      message: message,
+      room: current_room,
+      reply_to: reply_to,
+      client_key: next_client_key()
+    });
+    set_reply_to(null);
+  };
+
+  var show_users = function() {
+    var users_frame = $("#container .users-frame");
+    var users = room_users[current_room] || [];
+    users_frame.empty();
+    users_frame.append($("<p>").addClass("room").text("#" + current_room));
+    for (var i = 0; i < users.length; i++) {
+      var user = users[i];
+      var text = user.name;
+      if (user.presence != "online") {
+        text += " (" + user.presence + ")";
       }
-    }));
+      users_frame.append($("<p>").addClass(user.presence).text(text));
+    }
+
+    var now = Date.now();
+    for (var name in typing_users) {
+      var typing = typing_users[name];
+      if (typing.expires < now) {
+        delete typing_users[name];
+      } else if (typing.private || typing.room == current_room) {
+        users_frame.append($("<p>").addClass("typing").text(name + " is typing..."));
+      }
+    }
+  };
+
+  // Typing notices expire on their own unless they are refreshed.
+  setInterval(show_users, 1000);
+
+  var send_typing = function() {
+    var now = Date.now();
+    if (ws && now - last_typing > 2000) {
+      last_typing = now;
+      send_command("typing", {room: current_room, typing: true});
+    }
   };
 
   var open_websocket = function() {
+    var url = "://" + location.host + "/connect" + location.search;
+    if (resume_token) {
+      // Lets the server know the name we asked for is still ours.
+      url += (location.search ? "&" : "?") + "resume=" + encodeURIComponent(resume_token);
+    }
     if (location.protocol == "https:") {
-      ws = this.ws = new WebSocket("wss://" + location.host + "/connect");
+      ws = this.ws = new WebSocket("wss" + url);
     } else {
-      ws = this.ws = new WebSocket("ws://" + location.host + "/connect");
+      ws = this.ws = new WebSocket("ws" + url);
     }
 
     var chat_frame = $("#container .chat-frame");
 
+    var notice = function(text, cls) {
+      chat_frame.append($("<p>").addClass("chat-message").addClass(cls).text(text));
+    };
+
+    var reactions_element = function(reactions) {
+      var span = $("<span>").addClass("reactions");
+      for (var emoji in reactions) {
+        var users = reactions[emoji];
+        span.append($("<span>").
+          addClass("reaction").
+          attr("title", users.join(", ")).
+          text(emoji + " " + users.length));
+      }
+      return span;
+    };
+
+    var message_element = function(args) {
+      var prefix = "";
+      if (args.room && args.room != current_room) {
+        prefix = "[" + args.room + "] ";
+      }
+      var text = prefix + args.sender + ": " + args.message;
+      if (args.action) {
+        text = prefix + "* " + args.sender + " " + args.message;
+      }
+      if (args.edited) {
+        text += " (edited)";
+      }
+      var msg = $("<p>").
+        addClass("chat-message").
+        attr("data-id", args.id).
+        text(text);
+      if (args.reactions) {
+        msg.append(reactions_element(args.reactions));
+      }
+      if (args.quote) {
+        msg.prepend($("<span>").addClass("quote").text("> " + args.quote.sender + ": " + args.quote.message));
+      }
+      msg.click(function() {
+        set_reply_to(args.id, args.sender);
+      });
+      if (args.time) {
+        msg.attr("title", new Date(args.time).toLocaleString());
+      }
+      if (args.mentions && args.mentions.indexOf(my_name) >= 0) {
+        msg.addClass("mention");
+      }
+      if (args.private) {
+        msg.addClass("private");
+      } else if (args.from_me) {
+        msg.addClass("from-me");
+      }
+      return msg;
+    };
+
     ws.onmessage = function(event) {
       var cmd = JSON.parse(event.data);
       switch (cmd.command) {
       case "message":
-        var msg = $("<p>").
-          addClass("chat-message").
-          text(cmd.args.sender + ": " + cmd.args.message);
-        if (cmd.args.private) {
-          msg.addClass("private");
-        } else if (cmd.args.from_me) {
-          msg.addClass("from-me");
+        if (typing_users[cmd.args.sender]) {
+          delete typing_users[cmd.args.sender];
+          show_users();
         }
+        var msg = message_element(cmd.args);
         var was_at_bottom = Math.abs(chat_frame.prop("scrollHeight") - chat_frame.scrollTop() - chat_frame.height()) < 5;
         chat_frame.append(msg);
         if (was_at_bottom) {
           chat_frame.animate({scrollTop: chat_frame.prop("scrollHeight")}, 200);
         }
         break;
+      case "history":
+        var messages = cmd.args.messages || [];
+        for (var i = 0; i < messages.length; i++) {
+          chat_frame.append(message_element(messages[i]).addClass("history"));
+        }
+        chat_frame.scrollTop(chat_frame.prop("scrollHeight"));
+        break;
       case "error":
-        var msg = $("<p>");
-        msg.text(cmd.args.message);
-        msg.addClass("chat-message");
-        msg.addClass("error");
-        chat_frame.append(msg);
+        notice(cmd.args.message, "error");
+        break;
+      case "command_output":
+        var lines = cmd.args.output.split("\n");
+        for (var i = 0; i < lines.length; i++) {
+          notice(lines[i], "welcome");
+        }
+        break;
+      case "thread":
+        var messages = cmd.args.messages || [];
+        notice("Thread of " + messages.length + " messages:", "welcome");
+        for (var i = 0; i < messages.length; i++) {
+          chat_frame.append(message_element(messages[i]).addClass("history"));
+        }
+        chat_frame.scrollTop(chat_frame.prop("scrollHeight"));
+        break;
+      case "message_edited":
+        var old = chat_frame.find("p[data-id=" + cmd.args.id + "]");
+        old.replaceWith(message_element(cmd.args).attr("class", old.attr("class")));
+        break;
+      case "mention":
+        if (!cmd.args.private && !room_users[cmd.args.room]) {
+          notice(cmd.args.sender + " mentioned you in #" + cmd.args.room + ": " + cmd.args.message, "mention");
+        }
+        break;
+      case "reaction_update":
+        var reacted = chat_frame.find("p[data-id=" + cmd.args.id + "]");
+        reacted.find("span.reactions").remove();
+        reacted.append(reactions_element(cmd.args.reactions));
+        break;
+      case "message_deleted":
+        chat_frame.find("p[data-id=" + cmd.args.id + "]").
+          addClass("deleted").
+          text("(message deleted)");
+        break;
+      case "ack":
+        if (cmd.args.failed) {
+          notice("Message not delivered to " + cmd.args.failed.join(", "), "error");
+        }
         break;
       case "welcome":
+        my_name = cmd.args.name;
+        resume_token = cmd.args.resume_token;
+        if (cmd.args.resumed) {
+          var text = "Reconnected as " + my_name;
+          if (cmd.args.dropped) {
+            text += ", " + cmd.args.dropped + " updates were lost";
+          }
+          notice(text, "welcome");
+          break;
+        }
         var msg = $("<p>");
         msg.text("Welcome! You are " + cmd.args.name);
         msg.addClass("chat-message");
@@ -64,19 +230,88 @@
         chat_frame.append(msg);
         break;
       case "users":
-        var users_frame = $("#container .users-frame");
-        users_frame.empty();
-        for (var i = 0; i < cmd.args.users.length; i++) {
-          users_frame.append($("<p>").text(cmd.args.users[i]));
+        room_users[cmd.args.room] = cmd.args.users || [];
+        show_users();
+        break;
+      case "typing":
+        if (cmd.args.typing) {
+          typing_users[cmd.args.name] = {
+            room: cmd.args.room,
+            private: cmd.args.private,
+            expires: Date.parse(cmd.args.expires)
+          };
+        } else {
+          delete typing_users[cmd.args.name];
+        }
+        show_users();
+        break;
+      case "moderation":
+        var past = {kick: "kicked", mute: "muted", ban: "banned"};
+        var text = "You were " + past[cmd.args.action] + " by " + cmd.args.by;
+        if (cmd.args.reason) {
+          text += ": " + cmd.args.reason;
+        }
+        notice(text, "error");
+        break;
+      case "moderated":
+        notice(cmd.args.action + " " + cmd.args.name + ": done", "welcome");
+        break;
+      case "server_shutdown":
+        notice(cmd.args.reason, "error");
+        break;
+      case "renamed":
+        if (cmd.args.old_name == my_name) {
+          my_name = cmd.args.new_name;
+          notice("You are now known as " + my_name, "welcome");
+        } else {
+          notice(cmd.args.old_name + " is now known as " + cmd.args.new_name, "welcome");
+        }
+        break;
+      case "joined_room":
+        current_room = cmd.args.room;
+        notice("You joined #" + cmd.args.room, "welcome");
+        show_users();
+        break;
+      case "left_room":
+        delete room_users[cmd.args.room];
+        notice("You left #" + cmd.args.room, "welcome");
+        if (current_room == cmd.args.room) {
+          current_room = "bridge";
         }
+        show_users();
+        break;
+      case "switched_room":
+        current_room = cmd.args.room;
+        show_users();
+        break;
+      case "rooms":
+        var rooms = cmd.args.rooms || [];
+        var names = [];
+        for (var i = 0; i < rooms.length; i++) {
+          names.push("#" + rooms[i].name + " (" + rooms[i].members + ")");
+        }
+        notice("Rooms: " + names.join(", "), "welcome");
         break;
       }
     };
 
     ws.onopen = function() {
+      if (resume_token) {
+        send_command("resume", {token: resume_token, version: 2, features: features});
+      } else {
+        send_command("hello", {version: 2, features: features});
+      }
       $("#container").show();
     };
 
+    ws.onclose = function(e) {
+      // 1006 is a connection lost without a close frame.
+      if (e.code == 1006 && resume_token) {
+        notice("Connection lost, reconnecting...", "error");
+        setTimeout(open_websocket, 1000);
+      }
+    };
+
     ws.onerror = function(e) {
       console.log("websocket error: " + e);
     };
@@ -84,26 +319,42 @@
 
   $(open_websocket);
 
+  var reconnect = function() {
+    ws.onclose = null;
+    ws.close();
+    $("#container .chat-frame").empty();
+    room_users = {};
+    typing_users = {};
+    current_room = "bridge";
+    resume_token = null;
+    open_websocket();
+  };
+
   $(function() {
-    $("input").keydown(function(e) {
+    $(".login-form button").click(function() {
+      var form = $(".login-form");
+      $.post($(this).data("action"), form.serialize()).
+        done(reconnect).
+        fail(function(xhr) {
+          alert(xhr.responseText);
+        });
+    });
+
+    $("input.chat-input").keydown(function(e) {
       if (e.keyCode == 13) {
         var msg = $(this).val();
         if (msg.length == 0) {
           return;
         }
 
-        if (msg[0] == "/") {
-          var match = msg.match(/^\/dm\s+(\S+)\s+(.+)$/);
-          if (match) {
-            private_message(match[1], match[2]);
-          } else {
-            return;
-          }
-        } else {
-          broadcast_message(msg);
-        }
+        // Slash commands, like everything else, are up to the server.
+        broadcast_message(msg);
 
         $(this).val("");
+      } else if (e.keyCode == 27) {
+        set_reply_to(null);
+      } else if ($(this).val()[0] != "/") {
+        send_typing();
       }
     });
   });
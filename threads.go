@@ -0,0 +1,120 @@
+// Copyright (c) 2016, RetailNext, Inc.
+// This material contains trade secrets and confidential information of
+// RetailNext, Inc.  Any use, reproduction, disclosure or dissemination
+// is strictly prohibited without the explicit written permission
+// of RetailNext, Inc.
+// All rights reserved.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// quoteLength is the most runes of a message quoted in a reply.
+const quoteLength = 140
+
+type quote struct {
+	Sender  string `json:"sender"`
+	Message string `json:"message"`
+}
+
+// messageIDArgs refers to a stored message.
+type messageIDArgs struct {
+	ID int64 `json:"id" schema:"required"`
+}
+
+// threadArgs answers get_thread with the messages of the thread, the first
+// one starting it.
+type threadArgs struct {
+	ID       int64         `json:"id"`
+	Messages []messageArgs `json:"messages"`
+}
+
+func (a messageIDArgs) validate() error {
+	if a.ID == 0 {
+		return errors.New("no message id given")
+	}
+	return nil
+}
+
+// threadReply checks that msg, from from, answers a message in the same
+// conversation that from can see, then files it in that message's thread
+// with a quote of it.
+func (s *server) threadReply(from Client, msg *messageArgs) error {
+	parent, ok := s.history.Get(msg.ReplyTo)
+	if !ok || !s.canSee(from, parent) {
+		return fmt.Errorf("message %d not found", msg.ReplyTo)
+	}
+	if parent.Deleted {
+		return fmt.Errorf("message %d was deleted", parent.ID)
+	}
+	if !sameConversation(parent, *msg) {
+		return errors.New("replies must go to the same room or person")
+	}
+
+	msg.Thread = parent.Thread
+	if msg.Thread == 0 {
+		msg.Thread = parent.ID
+	}
+	msg.Quote = &quote{
+		Sender:  parent.Sender,
+		Message: excerpt(parent.Message, quoteLength),
+	}
+	return nil
+}
+
+// thread returns the message that started the thread containing message id,
+// if it is still stored, and the replies to it.
+func (s *server) thread(c Client, id int64) ([]messageArgs, error) {
+	root := id
+	if msg, ok := s.history.Get(id); ok && msg.Thread != 0 {
+		root = msg.Thread
+	}
+
+	msgs := s.history.Thread(root)
+	if first, ok := s.history.Get(root); ok {
+		msgs = append([]messageArgs{first}, msgs...)
+	}
+	if len(msgs) == 0 || !s.canSee(c, msgs[0]) {
+		return nil, fmt.Errorf("message %d not found", id)
+	}
+
+	visible := msgs[:0]
+	for _, msg := range msgs {
+		if !msg.Deleted {
+			msg.FromMe = msg.Sender == c.Name()
+			visible = append(visible, msg)
+		}
+	}
+	return visible, nil
+}
+
+// canSee reports whether c is party to the private message msg, or in the
+// room it was posted to. A guest cannot see private messages from before it
+// took its name.
+func (s *server) canSee(c Client, msg messageArgs) bool {
+	if msg.Private {
+		return msg.involves(c.Name()) && !msg.Time.Before(nameSince(c))
+	}
+	return s.inRoom(c.Name(), msg.Room)
+}
+
+func sameConversation(a, b messageArgs) bool {
+	if a.Private != b.Private {
+		return false
+	}
+	if !a.Private {
+		return a.Room == b.Room
+	}
+	return b.involves(a.Sender) && b.involves(a.Recipient)
+}
+
+func excerpt(text string, n int) string {
+	runes := []rune(text)
+	if len(runes) <= n {
+		return text
+	}
+	return string(runes[:n]) + "…"
+}